@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"time"
+	"webrtc/protocol"
+)
+
+const (
+	phoneModeCarPlay     = "carplay"
+	phoneModeAndroidAuto = "androidauto"
+)
+
+const carPlayDPI int32 = 160
+
+// androidAutoModes are the video sizes Android Auto phones encode, with the
+// screen density that keeps the UI at its intended physical size.
+var androidAutoModes = []struct {
+	size deviceSize
+	dpi  int32
+}{
+	{deviceSize{Width: 800, Height: 480}, 160},
+	{deviceSize{Width: 1280, Height: 720}, 240},
+	{deviceSize{Width: 1920, Height: 1080}, 320},
+}
+
+// androidAutoMode picks the largest Android Auto resolution that fits into
+// the viewer, falling back to the smallest one.
+func androidAutoMode(viewer deviceSize) (deviceSize, int32) {
+	mode := androidAutoModes[0]
+	for _, m := range androidAutoModes[1:] {
+		if m.size.Width <= viewer.Width && m.size.Height <= viewer.Height {
+			mode = m
+		}
+	}
+	return mode.size, mode.dpi
+}
+
+// sendAndroidAutoSettings tells the dongle which resolution and density to
+// request from an Android phone and opens the screen with that resolution.
+func (s *session) sendAndroidAutoSettings(viewer deviceSize) {
+	aaSize, dpi := androidAutoMode(viewer)
+	link := s.link()
+	link.SendMessage(&protocol.SendFile{FileName: "/tmp/screen_dpi\x00", Content: intToByte(dpi)})
+	settings, err := protocol.NewBoxSettings(protocol.BoxConfig{
+		SyncTime:         time.Now().Unix(),
+		AndroidAutoSizeW: aaSize.Width,
+		AndroidAutoSizeH: aaSize.Height,
+	})
+	if err != nil {
+		log.Printf("[androidauto] %s\n", err)
+		return
+	}
+	link.SendMessage(settings)
+	link.SendMessage(openMessage(aaSize.Width, aaSize.Height, fps))
+}
+
+// adaptPhoneType switches density and resolution when the connected phone
+// does not match the configured mode: dongles accept Android phones in
+// CarPlay mode too, and those render too small with the CarPlay settings.
+// The CarPlay ones come back when the phone is unplugged.
+func (s *session) adaptPhoneType(data interface{}) {
+	link := s.link()
+	if link == nil || cfg.PhoneMode == phoneModeAndroidAuto {
+		return
+	}
+	switch data := data.(type) {
+	case *protocol.Plugged:
+		adapt := data.PhoneType == protocol.PhoneAndroidAuto
+		s.sizeMu.Lock()
+		s.androidAdapted = adapt
+		s.sizeMu.Unlock()
+		if adapt {
+			viewer := s.viewerSize()
+			log.Println("android auto phone connected, adapting resolution", viewer.Width, viewer.Height)
+			s.sendAndroidAutoSettings(viewer)
+		}
+	case *protocol.Unplugged:
+		s.sizeMu.Lock()
+		adapted := s.androidAdapted
+		s.androidAdapted = false
+		s.sizeMu.Unlock()
+		if adapted {
+			viewer := s.viewerSize()
+			link.SendMessage(&protocol.SendFile{FileName: "/tmp/screen_dpi\x00", Content: intToByte(carPlayDPI)})
+			link.SendMessage(openMessage(viewer.Width, viewer.Height, fps))
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"webrtc/protocol"
+	"webrtc/usblink"
+)
+
+func TestAdaptPhoneType(t *testing.T) {
+	cfg.PhoneMode = phoneModeCarPlay
+	link := &sentLink{}
+	s := newSession("test", usblink.Selector{})
+	s.usbLink = link
+	s.setViewerSize(deviceSize{Width: 1400, Height: 800})
+
+	opened := func() *protocol.Open {
+		link.mu.Lock()
+		defer link.mu.Unlock()
+		var open *protocol.Open
+		for _, msg := range link.sent {
+			if msg, ok := msg.(*protocol.Open); ok {
+				open = msg
+			}
+		}
+		link.sent = nil
+		return open
+	}
+
+	// the status sees the message first, as it may
+	plugged := &protocol.Plugged{PhoneType: protocol.PhoneAndroidAuto}
+	s.status.onData(plugged)
+	s.adaptPhoneType(plugged)
+	if open := opened(); open == nil || open.Width != 1280 || open.Height != 720 {
+		t.Fatalf("Open for the Android phone: %#v", open)
+	}
+
+	s.status.onData(&protocol.Unplugged{})
+	s.adaptPhoneType(&protocol.Unplugged{})
+	if open := opened(); open == nil || open.Width != 1400 || open.Height != 800 {
+		t.Fatalf("Open after unplugging: %#v", open)
+	}
+
+	s.adaptPhoneType(&protocol.Plugged{PhoneType: protocol.PhoneCarPlay})
+	s.adaptPhoneType(&protocol.Unplugged{})
+	if open := opened(); open != nil {
+		t.Fatalf("an iPhone changed the layout: %#v", open)
+	}
+}
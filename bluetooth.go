@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"webrtc/protocol"
+)
+
+type bluetoothInfo struct {
+	Address     string                  `json:"address,omitempty"`
+	PIN         string                  `json:"pin,omitempty"`
+	Name        string                  `json:"name,omitempty"`
+	Paired      []protocol.PairedDevice `json:"paired"`
+	AutoConnect string                  `json:"autoConnect,omitempty"`
+}
+
+type bluetoothState struct {
+	mu     sync.Mutex
+	info   bluetoothInfo
+	events *eventHub
+}
+
+func (b *bluetoothState) get() bluetoothInfo {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	info := b.info
+	info.Paired = append([]protocol.PairedDevice{}, b.info.Paired...)
+	return info
+}
+
+func (b *bluetoothState) update(fn func(*bluetoothInfo)) {
+	b.mu.Lock()
+	fn(&b.info)
+	b.mu.Unlock()
+
+	b.events.publish("bluetooth", b.get())
+}
+
+func (b *bluetoothState) onData(data interface{}) {
+	switch data := data.(type) {
+	case *protocol.BluetoothAddress:
+		b.update(func(info *bluetoothInfo) {
+			info.Address = trimNull(data.Address)
+		})
+	case *protocol.BluetoothPIN:
+		b.update(func(info *bluetoothInfo) {
+			info.PIN = trimNull(data.Address)
+		})
+	case *protocol.BluetoothDeviceName:
+		b.update(func(info *bluetoothInfo) {
+			info.Name = trimNull(data.Data)
+		})
+	case *protocol.BluetoothPairedList:
+		b.update(func(info *bluetoothInfo) {
+			info.Paired = data.Devices
+		})
+	case *protocol.BoxSettings:
+		if data.Box == nil || data.Box.DevList == nil {
+			return
+		}
+		paired := make([]protocol.PairedDevice, 0, len(data.Box.DevList))
+		for _, dev := range data.Box.DevList {
+			paired = append(paired, protocol.PairedDevice{Address: dev.ID, Name: dev.Name})
+		}
+		b.update(func(info *bluetoothInfo) {
+			info.Paired = paired
+		})
+	}
+}
+
+func trimNull(s protocol.NullTermString) string {
+	return strings.TrimRight(string(s), "\x00")
+}
+
+func validBluetoothAddress(addr string) bool {
+	if len(addr) != 17 {
+		return false
+	}
+	for i, c := range addr {
+		if i%3 == 2 {
+			if c != ':' {
+				return false
+			}
+		} else if !strings.ContainsRune("0123456789ABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *session) bluetoothHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.bluetooth.get())
+}
+
+// pairedDeviceHandler serves DELETE /api/bluetooth/paired/<address>, which
+// makes the dongle forget the phone.
+func (s *session) pairedDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use DELETE"))
+		return
+	}
+	addr := strings.ToUpper(strings.TrimPrefix(r.URL.Path, "/api/bluetooth/paired/"))
+	if !validBluetoothAddress(addr) {
+		writeError(w, http.StatusBadRequest, errors.New("invalid bluetooth address"))
+		return
+	}
+	link := s.link()
+	if link == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("dongle is not started"))
+		return
+	}
+	if err := link.SendMessage(&protocol.ForgetBluetooth{Address: protocol.NullTermString(addr)}); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	s.bluetooth.update(func(info *bluetoothInfo) {
+		paired := info.Paired[:0]
+		for _, dev := range info.Paired {
+			if !strings.EqualFold(dev.Address, addr) {
+				paired = append(paired, dev)
+			}
+		}
+		info.Paired = paired
+		if info.AutoConnect == addr {
+			info.AutoConnect = ""
+		}
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// autoConnectHandler reads (GET) or chooses (PUT, {"address": "..."}) the
+// phone the dongle connects to.
+func (s *session) autoConnectHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, map[string]string{"address": s.bluetooth.get().AutoConnect})
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Address string `json:"address"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		addr := strings.ToUpper(req.Address)
+		if !validBluetoothAddress(addr) {
+			writeError(w, http.StatusBadRequest, errors.New("invalid bluetooth address"))
+			return
+		}
+		link := s.link()
+		if link == nil {
+			writeError(w, http.StatusServiceUnavailable, errors.New("dongle is not started"))
+			return
+		}
+		if err := link.SendMessage(&protocol.ConnectBluetooth{Address: protocol.NullTermString(addr)}); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		s.bluetooth.update(func(info *bluetoothInfo) {
+			info.AutoConnect = addr
+		})
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET or PUT"))
+	}
+}
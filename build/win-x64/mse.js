@@ -0,0 +1,173 @@
+// Fallback for browsers or networks where WebRTC does not work: the video
+// comes as fragmented MP4 over a WebSocket and plays through Media Source
+// Extensions, the touches go back over the same socket.
+const video = document.querySelector("video");
+const overlay = document.querySelector("#overlay");
+
+const viewerSize = () => ({
+  width: (video.clientWidth * devicePixelRatio) | 0,
+  height: (video.clientHeight * devicePixelRatio) | 0,
+});
+
+// how far behind the newest frame the video may lag before jumping ahead
+const maxLatency = 0.5;
+
+let sourceBuffer = null;
+let pending = [];
+
+const appendNext = () => {
+  if (sourceBuffer == null || sourceBuffer.updating || pending.length == 0) {
+    return;
+  }
+  sourceBuffer.appendBuffer(pending.shift());
+};
+
+const keepLive = () => {
+  const buffered = video.buffered;
+  if (buffered.length == 0) {
+    return;
+  }
+  const end = buffered.end(buffered.length - 1);
+  if (end - video.currentTime > maxLatency) {
+    video.currentTime = Math.max(buffered.start(buffered.length - 1), end - 0.05);
+  }
+  // keep a few seconds of history
+  if (!sourceBuffer.updating && video.currentTime - buffered.start(0) > 10) {
+    sourceBuffer.remove(buffered.start(0), video.currentTime - 5);
+  }
+};
+
+const init = ({ codec }) => {
+  const mime = `video/mp4; codecs="${codec}"`;
+  if (!MediaSource.isTypeSupported(mime)) {
+    console.error("unsupported video:", mime);
+    return;
+  }
+  const mediaSource = new MediaSource();
+  sourceBuffer = null;
+  pending = [];
+  video.src = URL.createObjectURL(mediaSource);
+  mediaSource.addEventListener("sourceopen", () => {
+    URL.revokeObjectURL(video.src);
+    sourceBuffer = mediaSource.addSourceBuffer(mime);
+    sourceBuffer.mode = "segments";
+    sourceBuffer.addEventListener("updateend", () => {
+      keepLive();
+      appendNext();
+    });
+    appendNext();
+  });
+};
+
+let dongle = "stopped";
+let phone = "unplugged";
+const render = () => {
+  if (dongle != "ready") {
+    overlay.textContent = "Connecting to the dongle...";
+  } else if (phone != "plugged") {
+    overlay.textContent = "Phone disconnected";
+  }
+  overlay.hidden = dongle == "ready" && phone == "plugged";
+};
+
+const url = new URL("ws", location.href);
+url.protocol = location.protocol == "https:" ? "wss:" : "ws:";
+const ws = new WebSocket(url);
+ws.binaryType = "arraybuffer";
+
+const send = (type, data) => {
+  if (ws.readyState == WebSocket.OPEN) {
+    ws.send(JSON.stringify({ type, ...data }));
+  }
+};
+
+ws.onopen = () => send("start", viewerSize());
+ws.onclose = () => {
+  overlay.textContent = "Connection lost, reload to reconnect";
+  overlay.hidden = false;
+};
+
+ws.onmessage = (e) => {
+  if (e.data instanceof ArrayBuffer) {
+    pending.push(e.data);
+    appendNext();
+    return;
+  }
+  const { type, data } = JSON.parse(e.data);
+  switch (type) {
+    case "init":
+      console.log("video:", data.codec, data.width, data.height);
+      init(data);
+      break;
+    case "dongle":
+      dongle = data.state;
+      break;
+    case "phone":
+      phone = data.state;
+      break;
+    case "error":
+      console.error("dongle:", data.message);
+      break;
+    case "incident":
+      console.warn("link incident:", data.kind, data.detail || "", "recovery:", data.recovery);
+      break;
+  }
+  render();
+};
+
+new ResizeObserver(() => send("resize", viewerSize())).observe(video);
+
+let pointerdown = false;
+const sendTouchEvent = ({ type, offsetX, offsetY }) => {
+  let action = 16;
+  if (type == "pointerdown") {
+    action = 14;
+    pointerdown = true;
+  } else if (pointerdown) {
+    switch (type) {
+      case "pointermove":
+        action = 15;
+        break;
+      case "pointerup":
+      case "pointercancel":
+      case "pointerout":
+        pointerdown = false;
+        action = 16;
+        break;
+    }
+  } else {
+    return;
+  }
+  send("touch", {
+    x: (offsetX * devicePixelRatio) | 0,
+    y: (offsetY * devicePixelRatio) | 0,
+    action,
+    ...viewerSize(),
+  });
+};
+
+video.addEventListener("pointerdown", sendTouchEvent);
+video.addEventListener("pointermove", sendTouchEvent);
+video.addEventListener("pointerup", sendTouchEvent);
+video.addEventListener("pointercancel", sendTouchEvent);
+video.addEventListener("pointerout", sendTouchEvent);
+
+// buttons from the keyboard, e.g. for a rotary controller mapped to keys
+const keyButtons = {
+  ArrowLeft: "left",
+  ArrowRight: "right",
+  ArrowDown: "down",
+  Enter: "select-down",
+  Backspace: "back",
+  Home: "home",
+};
+document.addEventListener("keydown", (e) => {
+  if (keyButtons[e.key]) {
+    send("button", { button: keyButtons[e.key] });
+  }
+});
+document.addEventListener("keyup", (e) => {
+  if (e.key == "Enter") {
+    send("button", { button: "select-up" });
+  }
+});
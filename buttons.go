@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"webrtc/protocol"
+)
+
+// buttons are the names of the buttons the API and send-button accept.
+var buttons = map[string]protocol.CarPlayType{
+	"siri":        protocol.BtnSiri,
+	"left":        protocol.BtnLeft,
+	"right":       protocol.BtnRight,
+	"select-down": protocol.BtnSelectDown,
+	"select-up":   protocol.BtnSelectUp,
+	"back":        protocol.BtnBack,
+	"down":        protocol.BtnDown,
+	"home":        protocol.BtnHome,
+	"play":        protocol.BtnPlay,
+	"pause":       protocol.BtnPause,
+	"next":        protocol.BtnNextTrack,
+	"prev":        protocol.BtnPrevTrack,
+}
+
+func buttonNames() string {
+	names := make([]string, 0, len(buttons))
+	for name := range buttons {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// buttonHandler presses a button, POST {"button": "home"}.
+func (s *session) buttonHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	var req struct {
+		Button string `json:"button"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if _, ok := buttons[req.Button]; !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown button %q, want one of %s", req.Button, buttonNames()))
+		return
+	}
+	if err := s.pressButton(req.Button); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *session) pressButton(name string) error {
+	button, ok := buttons[name]
+	if !ok {
+		return fmt.Errorf("unknown button %q", name)
+	}
+	link := s.link()
+	if link == nil {
+		return errors.New("dongle is not started")
+	}
+	return link.SendMessage(&protocol.CarPlay{Type: button})
+}
+
+// runSendButton is the send-button command: it presses a button through the
+// API of a server listening on -addr, on the dongle named by -dongle. As a
+// bare -dongle value is the selector of a dongle named "default", the name
+// is given as name=selector.
+func runSendButton(args []string) int {
+	fs := newFlagSet("send-button")
+	cfg = loadConfig(fs, args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		fmt.Fprintf(os.Stderr, "\nbuttons: %s\n", buttonNames())
+		return 2
+	}
+
+	host := cfg.Addr
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	url := "http://" + host + "/api/button"
+	if len(cfg.Dongles) > 0 {
+		url = "http://" + host + "/dongle/" + cfg.Dongles[0].Name + "/api/button"
+	}
+	body, _ := json.Marshal(map[string]string{"button": fs.Arg(0)})
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		var failure struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&failure)
+		fmt.Fprintf(os.Stderr, "%s: %s %s\n", url, resp.Status, failure.Error)
+		return 1
+	}
+	return 0
+}
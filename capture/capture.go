@@ -0,0 +1,138 @@
+// Package capture reads and writes recordings of the messages exchanged
+// with a dongle.
+//
+// A capture file starts with the magic "GOCPCAP1", followed by one record
+// per message: the time since the start of the recording in nanoseconds
+// (uint64), the direction (uint8), the message length (uint32), all little
+// endian, and the message itself, header included.
+package capture
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const magic = "GOCPCAP1"
+
+// maxRecord protects readers against corrupted lengths.
+const maxRecord = 64 << 20
+
+// Direction tells who sent a message.
+type Direction uint8
+
+const (
+	// In is a message from the dongle.
+	In Direction = iota
+	// Out is a message to the dongle.
+	Out
+)
+
+func (d Direction) String() string {
+	if d == Out {
+		return "out"
+	}
+	return "in"
+}
+
+// Record is one captured message.
+type Record struct {
+	Time time.Duration
+	Dir  Direction
+	Data []byte
+}
+
+// Writer appends records to a capture. It is safe for concurrent use.
+type Writer struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	start time.Time
+	err   error
+}
+
+// NewWriter writes the file magic and starts the recording clock.
+func NewWriter(w io.Writer) (*Writer, error) {
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(magic); err != nil {
+		return nil, err
+	}
+	return &Writer{w: bw, start: time.Now()}, nil
+}
+
+// Write records data, stamped with the time since the writer was created.
+// After an error all further writes fail with it.
+func (w *Writer) Write(dir Direction, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	var head [13]byte
+	binary.LittleEndian.PutUint64(head[0:], uint64(time.Since(w.start)))
+	head[8] = byte(dir)
+	binary.LittleEndian.PutUint32(head[9:], uint32(len(data)))
+	if _, w.err = w.w.Write(head[:]); w.err != nil {
+		return w.err
+	}
+	_, w.err = w.w.Write(data)
+	return w.err
+}
+
+// Flush writes buffered records to the underlying writer.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.w.Flush()
+	return w.err
+}
+
+// Reader reads the records of a capture.
+type Reader struct {
+	r *bufio.Reader
+}
+
+// NewReader checks the file magic.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(magic))
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, err
+	}
+	if string(head) != magic {
+		return nil, errors.New("not a capture file")
+	}
+	return &Reader{r: br}, nil
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (r *Reader) Next() (Record, error) {
+	var head [13]byte
+	if _, err := io.ReadFull(r.r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated capture record")
+		}
+		return Record{}, err
+	}
+	length := binary.LittleEndian.Uint32(head[9:])
+	if length > maxRecord {
+		return Record{}, errors.New("capture record too large")
+	}
+	rec := Record{
+		Time: time.Duration(binary.LittleEndian.Uint64(head[0:])),
+		Dir:  Direction(head[8]),
+		Data: make([]byte, length),
+	}
+	if _, err := io.ReadFull(r.r, rec.Data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errors.New("truncated capture record")
+		}
+		return Record{}, err
+	}
+	return rec, nil
+}
@@ -0,0 +1,63 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(Out, []byte("open"))
+	w.Write(In, []byte("video frame"))
+	w.Write(In, nil)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Record{{Dir: Out, Data: []byte("open")}, {Dir: In, Data: []byte("video frame")}, {Dir: In, Data: []byte{}}}
+	var last Record
+	for i, w := range want {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+		if rec.Dir != w.Dir || !bytes.Equal(rec.Data, w.Data) {
+			t.Errorf("record %d = %s %q; want %s %q", i, rec.Dir, rec.Data, w.Dir, w.Data)
+		}
+		if rec.Time < last.Time {
+			t.Errorf("record %d goes back in time", i)
+		}
+		last = rec
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Fatalf("Next after the last record = %v; want io.EOF", err)
+	}
+}
+
+func TestTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	w, _ := NewWriter(&buf)
+	w.Write(In, []byte("video frame"))
+	w.Flush()
+
+	r, err := NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Next(); err == nil || err == io.EOF {
+		t.Fatalf("Next on a truncated record = %v", err)
+	}
+
+	if _, err := NewReader(bytes.NewReader([]byte("not a capture"))); err == nil {
+		t.Fatal("NewReader accepted a foreign file")
+	}
+}
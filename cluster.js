@@ -0,0 +1,37 @@
+const video = document.querySelector("video");
+
+const pc = new RTCPeerConnection();
+
+pc.ontrack = (event) => {
+  video.srcObject = event.streams[0];
+};
+
+pc.oniceconnectionstatechange = () => {
+  console.log("connection:", pc.iceConnectionState);
+};
+
+pc.onicecandidate = (event) => {
+  if (event.candidate == null) {
+    fetch("connect?stream=navi", {
+      method: "POST",
+      body: JSON.stringify(pc.localDescription),
+    })
+      .then((res) => Promise.all([res.json(), res.ok]))
+      .then(([answer, ok]) => {
+        if (!ok) {
+          return Promise.reject(answer);
+        }
+        return pc.setRemoteDescription(new RTCSessionDescription(answer));
+      })
+      .catch(console.error);
+  }
+};
+
+pc.addTransceiver("video", { direction: "recvonly" });
+
+fetch("api/ice")
+  .then((res) => res.json())
+  .then(({ iceServers }) => pc.setConfiguration({ ...pc.getConfiguration(), iceServers }))
+  .then(() => pc.createOffer())
+  .then((d) => pc.setLocalDescription(d))
+  .catch(console.error);
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"webrtc/gnss"
+)
+
+// command is a subcommand of the binary, e.g. "gocarplay record -o x.cap".
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(args []string) int
+}
+
+// commandList is a function rather than a variable because the commands
+// print it in their usage.
+func commandList() []command {
+	return []command{
+		{"serve", "[flags]", "serve the dongles to WebRTC viewers, the default command", runServe},
+		{"probe", "[flags]", "report a dongle's descriptors, handshake, round trip and throughput", runProbe},
+		{"record", "[flags] -o <file>", "run a dongle without viewers and capture its USB traffic", runRecord},
+		{"replay", "[flags] <file>", "serve a capture to the viewers as if it came from a dongle", runReplay},
+		{"dissect", "[-json] <file>", "print the messages of a capture", runDissect},
+		{"emulate", "[flags]", "serve an emulated dongle with a plugged phone", runEmulate},
+		{"send-button", "[flags] <button>", "press a button through a running server; -dongle name=selector picks the dongle by name, a bare selector picks the one named \"default\"", runSendButton},
+	}
+}
+
+// run dispatches the command line. Without a command, or with flags only,
+// the binary serves as it always did.
+func run(args []string) int {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return runServe(args)
+	}
+	if args[0] == "help" {
+		usage()
+		return 0
+	}
+	for _, c := range commandList() {
+		if c.name == args[0] {
+			return c.run(args[1:])
+		}
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	usage()
+	return 2
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags]\n\ncommands:\n", filepath.Base(os.Args[0]))
+	for _, c := range commandList() {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nrun %s <command> -h for the flags of a command\n", filepath.Base(os.Args[0]))
+}
+
+// newFlagSet creates the flag set of a command with a usage naming it.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		for _, c := range commandList() {
+			if c.name == name {
+				fmt.Fprintf(fs.Output(), "usage: %s %s %s\n\n%s\n\n", filepath.Base(os.Args[0]), c.name, c.args, c.summary)
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// firstDongle is the dongle of the commands that handle a single one.
+func firstDongle() dongleConfig {
+	if len(cfg.Dongles) > 0 {
+		return cfg.Dongles[0]
+	}
+	return dongleConfig{Name: "default"}
+}
+
+// runServe is the serve command: one session per -dongle flag.
+func runServe(args []string) int {
+	cfg = loadConfig(newFlagSet("serve"), args)
+	dongles := cfg.Dongles
+	if len(dongles) == 0 {
+		dongles = dongleFlags{{Name: "default"}}
+	}
+	for _, dongle := range dongles {
+		sessions = append(sessions, newSession(dongle.Name, dongle.Device))
+	}
+	if err := startSinks(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return listen()
+}
+
+// listen serves the sessions and the endpoints shared by them until the
+// HTTP server fails.
+func listen() int {
+	if _, err := sharedWebRTCAPI(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if cfg.TURN != "" {
+		if err := startTURN(); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	for _, s := range sessions {
+		http.Handle(s.prefix+"/", http.StripPrefix(s.prefix, s.handler()))
+		log.Printf("dongle %s (%s): http://localhost%s%s/\n", s.name, s.device, cfg.Addr, s.prefix)
+	}
+	if cfg.GNSS != "" {
+		go gnss.Run(cfg.GNSS, cfg.GNSSInterval, broadcastGnss, nil)
+	}
+
+	log.Println("http://localhost" + cfg.Addr)
+	http.HandleFunc("/api/dongles", donglesHandler)
+	http.HandleFunc("/api/usb", usbHandler)
+	http.Handle("/", sessions[0].handler())
+	log.Println(http.ListenAndServe(cfg.Addr, nil))
+	return 1
+}
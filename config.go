@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+	"webrtc/sink"
+	"webrtc/touch"
+	"webrtc/usblink"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+type config struct {
+	Addr         string
+	PhoneMode    string
+	GNSS         string
+	GNSSInterval time.Duration
+	MediaDelay   int
+	Wifi         bool
+	WifiName     string
+	WifiBand     string
+	WifiChannel  int
+	AutoConnect  string
+	NaviWidth    int
+	NaviHeight   int
+	NaviFPS      int
+
+	VideoFit      touch.Fit
+	VideoRotation int
+	VideoMirrorX  bool
+	VideoMirrorY  bool
+	TouchRate     int
+	USBBatch      map[usblink.Priority]time.Duration
+	Watchdog      usblink.WatchdogConfig
+	Dongles       dongleFlags
+	Sinks         []string
+	Width         int
+	Height        int
+	RecordDir     string
+	RecordRotate  time.Duration
+	RecordAudio   bool
+	AudioChannel  bool
+	HLSPart       time.Duration
+	HLSSegment    time.Duration
+	ICEServers    []webrtc.ICEServer
+	LAN           bool
+	UDPPortMin    uint16
+	UDPPortMax    uint16
+	UDPMux        string
+	NATIPs        []string
+	MDNS          ice.MulticastDNSMode
+	TURN          string
+	TURNIP        net.IP
+	TURNTTL       time.Duration
+}
+
+// loadConfig registers the flags shared by the commands on fs, next to the
+// command's own ones, and parses args.
+func loadConfig(fs *flag.FlagSet, args []string) config {
+	var cfg config
+	fs.StringVar(&cfg.Addr, "addr", ":8001", "HTTP listen address")
+	fs.StringVar(&cfg.PhoneMode, "phone-mode", phoneModeCarPlay, "phone projection mode: carplay or androidauto")
+	fs.StringVar(&cfg.GNSS, "gnss", "", "NMEA location source forwarded to the phone: serial device, file://track.nmea, gpsd://host:2947 or tcp://host:port")
+	fs.DurationVar(&cfg.GNSSInterval, "gnss-interval", time.Second, "minimum interval between location updates sent to the dongle")
+	fs.IntVar(&cfg.MediaDelay, "media-delay", 300, "dongle media delay in milliseconds")
+	fs.BoolVar(&cfg.Wifi, "wifi", false, "enable wireless CarPlay")
+	fs.StringVar(&cfg.WifiName, "wifi-name", "", "name of the dongle's Wi-Fi access point (empty keeps the dongle's name)")
+	fs.StringVar(&cfg.WifiBand, "wifi-band", "5g", "Wi-Fi band of the dongle's access point: 2.4g or 5g")
+	fs.IntVar(&cfg.WifiChannel, "wifi-channel", 0, "Wi-Fi channel of the dongle's access point (0 keeps the dongle's choice)")
+	fs.StringVar(&cfg.AutoConnect, "bt-autoconnect", "", "bluetooth address of the paired phone the dongle should connect to")
+	fs.IntVar(&cfg.NaviWidth, "navi-width", 0, "width of the navigation video stream for an instrument cluster (0 disables it)")
+	fs.IntVar(&cfg.NaviHeight, "navi-height", 0, "height of the navigation video stream")
+	fs.IntVar(&cfg.NaviFPS, "navi-fps", 30, "frame rate of the navigation video stream")
+	videoFit := fs.String("video-fit", "contain", "how viewers scale the video into their element: contain, fill or cover")
+	fs.IntVar(&cfg.VideoRotation, "video-rotation", 0, "clockwise rotation of the video in the viewer: 0, 90, 180 or 270")
+	fs.BoolVar(&cfg.VideoMirrorX, "video-mirror-x", false, "the viewer mirrors the video horizontally")
+	fs.BoolVar(&cfg.VideoMirrorY, "video-mirror-y", false, "the viewer mirrors the video vertically")
+	fs.IntVar(&cfg.TouchRate, "touch-rate", 60, "maximum touch moves sent to the dongle per second (0 for no limit)")
+	usbBatch := fs.String("usb-batch", "", "per class limits for batching USB writes, e.g. input=0,control=20ms,heartbeat=100ms,bulk=300ms")
+	fs.DurationVar(&cfg.Watchdog.VideoTimeout, "watchdog-video", usblink.DefaultWatchdog.VideoTimeout, "recover when no video arrives for this long while a phone is plugged (0 disables it)")
+	fs.DurationVar(&cfg.Watchdog.LinkTimeout, "watchdog-link", usblink.DefaultWatchdog.LinkTimeout, "recover when the dongle sends nothing for this long (0 disables it)")
+	recovery := fs.String("watchdog-recovery", usblink.DefaultWatchdog.Recovery.String(), "first recovery for a stalled link: none, reinit, reconnect or reset; repeated stalls escalate, USB errors always reconnect")
+	fs.Var(&cfg.Dongles, "dongle", "serve a dongle as [name=]selector, the selector being path:<bus>-<port>[.<port>...], serial:<serial> or any; repeat for several dongles")
+	fs.Func("sink", "also write the video to file:<path> (Annex-B H.264, a named pipe works too), unix:<path> (a socket serving length-prefixed frames) or exec:<command> (a process reading Annex-B on stdin); {dongle} stands for the dongle name; repeat for several sinks", func(spec string) error {
+		if _, _, err := sink.ParseSpec(spec); err != nil {
+			return err
+		}
+		cfg.Sinks = append(cfg.Sinks, spec)
+		return nil
+	})
+	fs.IntVar(&cfg.Width, "width", 800, "screen width announced to the phone when the dongle starts without a viewer")
+	fs.IntVar(&cfg.Height, "height", 480, "screen height announced to the phone when the dongle starts without a viewer")
+	fs.StringVar(&cfg.RecordDir, "record-dir", "recordings", "directory of the MP4 recordings started through /api/recording")
+	fs.DurationVar(&cfg.RecordRotate, "record-rotate", 15*time.Minute, "begin a new MP4 file after this long")
+	fs.BoolVar(&cfg.RecordAudio, "record-audio", false, "record the phone's audio next to the video")
+	fs.BoolVar(&cfg.AudioChannel, "audio-channel", false, "send the phone's audio to the viewers over the audio data channel")
+	fs.DurationVar(&cfg.HLSPart, "hls-part", 200*time.Millisecond, "length of the parts of the HLS stream")
+	fs.DurationVar(&cfg.HLSSegment, "hls-segment", 2*time.Second, "length of the HLS segments; they end at keyframes so may run longer")
+	fs.Func("ice-server", "STUN or TURN server of the peer connections, e.g. stun:host:3478 or user:password@turn:host:3478; repeat for several servers (default "+defaultICEServer+")", func(value string) error {
+		server, err := parseICEServer(value)
+		if err == nil {
+			cfg.ICEServers = append(cfg.ICEServers, server)
+		}
+		return err
+	})
+	fs.BoolVar(&cfg.LAN, "lan", false, "LAN-only mode for networks without internet: no ICE servers other than the -turn one, UDP host candidates only")
+	fs.Func("udp-ports", "UDP port range of the peer connections, min-max", func(value string) (err error) {
+		cfg.UDPPortMin, cfg.UDPPortMax, err = parsePortRange(value)
+		return err
+	})
+	fs.StringVar(&cfg.UDPMux, "udp-mux", "", "serve all peer connections on this single UDP address, e.g. :8443")
+	fs.Func("nat-ip", "public IP of a 1:1 NAT announced in place of the host addresses; comma separated for several", func(value string) error {
+		for _, ip := range strings.Split(value, ",") {
+			if net.ParseIP(ip) == nil {
+				return fmt.Errorf("%q is not an IP address", ip)
+			}
+			cfg.NATIPs = append(cfg.NATIPs, ip)
+		}
+		return nil
+	})
+	fs.StringVar(&cfg.TURN, "turn", "", "run a TURN server on this UDP address, e.g. :3478, for viewers whose network blocks UDP between peers; viewers get short-lived credentials when signalling; needs -udp-mux or -udp-ports")
+	fs.Func("turn-ip", "IPv4 address the TURN server relays on, and where viewers reach it unless -turn names one (default the first IPv4 address of this machine)", func(value string) error {
+		if cfg.TURNIP = net.ParseIP(value).To4(); cfg.TURNIP == nil {
+			return fmt.Errorf("%q is not an IPv4 address", value)
+		}
+		return nil
+	})
+	fs.DurationVar(&cfg.TURNTTL, "turn-ttl", 10*time.Minute, "how long the TURN credentials handed to a viewer stay valid")
+	mdns := fs.String("mdns", "query", "mDNS candidates: off, query (resolve the viewers' .local candidates) or gather (also hide our addresses behind .local names)")
+	fs.Parse(args)
+
+	if cfg.PhoneMode != phoneModeCarPlay && cfg.PhoneMode != phoneModeAndroidAuto {
+		log.Fatalf("unknown phone mode %q", cfg.PhoneMode)
+	}
+
+	var err error
+	if cfg.Watchdog.Recovery, err = usblink.ParseRecovery(*recovery); err != nil {
+		log.Fatal(err)
+	}
+
+	if *usbBatch != "" {
+		windows, err := usblink.ParseBatchWindow(*usbBatch)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cfg.USBBatch = windows
+	}
+
+	mode, ok := mdnsModes[*mdns]
+	if !ok {
+		log.Fatalf("unknown mDNS mode %q", *mdns)
+	}
+	cfg.MDNS = mode
+	if len(cfg.ICEServers) == 0 && !cfg.LAN {
+		server, _ := parseICEServer(defaultICEServer)
+		cfg.ICEServers = []webrtc.ICEServer{server}
+	}
+	if err := checkICE(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	switch *videoFit {
+	case "fill":
+		cfg.VideoFit = touch.Fill
+	case "cover":
+		cfg.VideoFit = touch.Cover
+	case "contain":
+		cfg.VideoFit = touch.Contain
+	default:
+		log.Fatalf("unknown video fit %q", *videoFit)
+	}
+	switch cfg.VideoRotation {
+	case 0, 90, 180, 270:
+	default:
+		log.Fatalf("video rotation %d is not 0, 90, 180 or 270", cfg.VideoRotation)
+	}
+	return cfg
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"webrtc/capture"
+	"webrtc/protocol"
+)
+
+// dissectEntry is a line of the dissect command's -json output.
+type dissectEntry struct {
+	Time    float64 `json:"time"`
+	Dir     string  `json:"dir"`
+	Type    string  `json:"type"`
+	Length  int     `json:"length"`
+	Summary string  `json:"summary"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// dissectSummaryMax keeps the summaries of the larger messages readable.
+const dissectSummaryMax = 120
+
+// runDissect is the dissect command: it prints one line per captured message
+// with its time, direction, type and a summary of the payload.
+func runDissect(args []string) int {
+	fs := newFlagSet("dissect")
+	asJSON := fs.Bool("json", false, "print one JSON object per message")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	r, err := capture.NewReader(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", fs.Arg(0), err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		entry := dissect(rec)
+		if *asJSON {
+			enc.Encode(entry)
+			continue
+		}
+		if entry.Error != "" {
+			entry.Summary = "error: " + entry.Error
+		}
+		fmt.Printf("%10.3f %-3s %-30s %8d %s\n", entry.Time, entry.Dir, entry.Type, entry.Length, entry.Summary)
+	}
+}
+
+func dissect(rec capture.Record) dissectEntry {
+	entry := dissectEntry{Time: rec.Time.Seconds(), Dir: rec.Dir.String(), Length: len(rec.Data)}
+	hdr, msg, err := protocol.Decode(rec.Data)
+	if err != nil {
+		entry.Type = fmt.Sprintf("%#x", hdr.Type)
+		entry.Error = err.Error()
+		return entry
+	}
+	entry.Type = fmt.Sprintf("%T", msg)
+	entry.Summary = summarize(msg)
+	return entry
+}
+
+// summarize describes a message without dumping its bulk data.
+func summarize(msg interface{}) string {
+	var summary string
+	switch msg := msg.(type) {
+	case protocol.VideoData:
+		summary = fmt.Sprintf("%dx%d flags=%d %d bytes", msg.Width, msg.Height, msg.Flags, len(msg.Data))
+	case *protocol.NaviVideoData:
+		summary = fmt.Sprintf("%dx%d flags=%d %d bytes", msg.Width, msg.Height, msg.Flags, len(msg.Data))
+	case protocol.AudioData:
+		summary = fmt.Sprintf("decode=%d type=%d volume=%g command=%d %d bytes", msg.DecodeType, msg.AudioType, msg.Volume, msg.Command, len(msg.Data))
+	case *protocol.SendFile:
+		summary = fmt.Sprintf("%s %d bytes", trimNull(msg.FileName), len(msg.Content))
+	case *protocol.CarPlay:
+		summary = fmt.Sprintf("%#v", msg.Type)
+	default:
+		summary = strings.TrimPrefix(fmt.Sprintf("%+v", msg), "&")
+	}
+	if len(summary) > dissectSummaryMax {
+		summary = summary[:dissectSummaryMax] + "..."
+	}
+	return summary
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"sync"
+	"time"
+	"webrtc/protocol"
+	"webrtc/usblink"
+)
+
+// runEmulate is the emulate command: it serves a dongle that answers the
+// init handshake and plugs a CarPlay phone, to try the viewers and the API
+// without hardware. With -capture the video of a capture plays in a loop.
+func runEmulate(args []string) int {
+	fs := newFlagSet("emulate")
+	video := fs.String("capture", "", "capture whose video the emulated phone shows in a loop")
+	cfg = loadConfig(fs, args)
+	if *video != "" {
+		if err := checkCapture(*video); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+
+	s := newSession("default", usblink.Selector{})
+	s.newLink = func() dongleLink {
+		return &emulatedLink{video: *video}
+	}
+	sessions = []*session{s}
+	if err := startSinks(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return listen()
+}
+
+// emulatedLink plays the dongle's part of the protocol well enough for the
+// session: it introduces itself after the first Open, then reports a plugged
+// phone. It counts the touches and logs the buttons it receives.
+type emulatedLink struct {
+	video string
+
+	mu        sync.Mutex
+	callbacks linkCallbacks
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	since     time.Time
+	plugged   bool
+	touches   int
+	buttons   int
+}
+
+// emulatedAnswerDelay is how long the emulated dongle takes to answer.
+const emulatedAnswerDelay = 100 * time.Millisecond
+
+func (l *emulatedLink) Start(onReadySend func(), onVideo func(protocol.VideoData), onAudio func(protocol.AudioData), onData func(interface{}), onError func(error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		return nil
+	}
+	l.callbacks = linkCallbacks{onReadySend, onVideo, onAudio, onData, onError}
+	l.stop = make(chan struct{})
+	l.since = time.Now()
+	l.plugged = false
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		onReadySend()
+	}()
+	return nil
+}
+
+func (l *emulatedLink) Stop() {
+	l.mu.Lock()
+	if l.stop == nil {
+		l.mu.Unlock()
+		return
+	}
+	close(l.stop)
+	l.stop = nil
+	log.Printf("[emulate] stopped after %d touches and %d buttons\n", l.touches, l.buttons)
+	l.mu.Unlock()
+	l.wg.Wait()
+}
+
+func (l *emulatedLink) SendMessage(msg interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == nil {
+		return usblink.ErrStopped
+	}
+	switch msg := msg.(type) {
+	case *protocol.Open:
+		log.Printf("[emulate] open %dx%d\n", msg.Width, msg.Height)
+		if !l.plugged {
+			l.plugged = true
+			l.goAnswer(l.plug)
+		}
+	case *protocol.Touch:
+		l.touches++
+		if msg.Action != protocol.TouchMove {
+			log.Printf("[emulate] touch %d at %d,%d\n", msg.Action, msg.X, msg.Y)
+		}
+	case *protocol.CarPlay:
+		switch {
+		case msg.Type.IsButton():
+			l.buttons++
+			log.Printf("[emulate] button %#v\n", msg.Type)
+		case msg.Type == protocol.RequestKeyFrame:
+			log.Println("[emulate] key frame requested")
+		}
+	}
+	return nil
+}
+
+func (l *emulatedLink) SendMessageWait(msg interface{}) error {
+	return l.SendMessage(msg)
+}
+
+// goAnswer runs fn after the answer delay unless the link stops first.
+func (l *emulatedLink) goAnswer(fn func(stop chan struct{})) {
+	stop := l.stop
+	l.wg.Add(1)
+	go func() {
+		defer l.wg.Done()
+		select {
+		case <-time.After(emulatedAnswerDelay):
+			fn(stop)
+		case <-stop:
+		}
+	}()
+}
+
+// plug introduces the dongle, plugs the phone and plays the video.
+func (l *emulatedLink) plug(stop chan struct{}) {
+	onData := l.callbacks.onData
+	onData(&protocol.SoftwareVersion{Version: protocol.NullTermString("emulator")})
+	onData(&protocol.BluetoothAddress{Address: protocol.NullTermString("00:11:22:33:44:55")})
+	onData(&protocol.BluetoothDeviceName{Data: protocol.NullTermString("emulator")})
+	onData(&protocol.WifiDeviceName{Data: protocol.NullTermString("emulator")})
+	onData(&protocol.Plugged{PhoneType: protocol.PhoneCarPlay})
+	if l.video == "" {
+		return
+	}
+	for {
+		err := playCapture(l.video, 1, stop, func(msg interface{}) {
+			if video, ok := msg.(protocol.VideoData); ok {
+				l.callbacks.onVideo(video)
+			}
+		})
+		if err != io.EOF {
+			if err != nil {
+				l.callbacks.onError(err)
+			}
+			return
+		}
+	}
+}
+
+func (l *emulatedLink) Health() usblink.Health {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == nil {
+		return usblink.Health{}
+	}
+	since := l.since
+	return usblink.Health{Connected: true, Since: &since, Device: "emulator", PhonePlugged: l.plugged}
+}
+
+func (l *emulatedLink) Recover(r usblink.Recovery) error {
+	return errors.New("the emulator cannot recover")
+}
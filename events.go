@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// event is a notification about the dongle or the phone, fanned out to
+// every browser connection that subscribed to it.
+type event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data,omitempty"`
+}
+
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[chan event]struct{}
+}
+
+func (h *eventHub) subscribe() chan event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[chan event]struct{})
+	}
+	ch := make(chan event, 64)
+	h.subs[ch] = struct{}{}
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// publish never blocks: a subscriber that does not keep up loses events.
+func (h *eventHub) publish(typ string, data interface{}) {
+	ev := event{Type: typ, Time: time.Now(), Data: data}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// forward sends the events of the given types over dc as JSON until the
+// channel closes. initial, if not nil, is called once the channel opens to
+// send the current state.
+func (h *eventHub) forward(dc *webrtc.DataChannel, initial func() []event, types ...string) {
+	dc.OnOpen(func() {
+		ch := h.subscribe()
+		dc.OnClose(func() {
+			h.unsubscribe(ch)
+		})
+		if initial != nil {
+			for _, ev := range initial() {
+				if data, err := json.Marshal(ev); err == nil {
+					dc.SendText(string(data))
+				}
+			}
+		}
+		go func() {
+			for ev := range ch {
+				if !eventMatches(ev, types) {
+					continue
+				}
+				data, err := json.Marshal(ev)
+				if err != nil {
+					continue
+				}
+				if err = dc.SendText(string(data)); err != nil {
+					h.unsubscribe(ch)
+				}
+			}
+		}()
+	})
+}
+
+func eventMatches(ev event, types []string) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for _, typ := range types {
+		if ev.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// eventsHandler streams events as Server-Sent Events. The optional "types"
+// query parameter is a comma separated list of event types to receive.
+func (s *session) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	var types []string
+	if t := r.URL.Query().Get("types"); t != "" {
+		types = strings.Split(t, ",")
+	}
+
+	ch := s.events.subscribe()
+	defer s.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(ev event) {
+		if !eventMatches(ev, types) {
+			return
+		}
+		data, err := json.Marshal(ev)
+		if err != nil {
+			return
+		}
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Type, data)
+		flusher.Flush()
+	}
+	for _, ev := range s.status.statusEvents() {
+		send(ev)
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			send(ev)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package fmp4
+
+import "encoding/binary"
+
+// NAL unit types the muxer cares about.
+const (
+	naluIDR = 5
+	naluSPS = 7
+	naluPPS = 8
+	naluAUD = 9
+)
+
+// SplitAnnexB returns the NAL units of an Annex-B access unit without their
+// start codes.
+func SplitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalus = appendNALU(nalus, data[start:i])
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 {
+		nalus = appendNALU(nalus, data[start:])
+	}
+	return nalus
+}
+
+// appendNALU drops the zeros that belong to the next four byte start code.
+func appendNALU(nalus [][]byte, nalu []byte) [][]byte {
+	for len(nalu) > 0 && nalu[len(nalu)-1] == 0 {
+		nalu = nalu[:len(nalu)-1]
+	}
+	if len(nalu) == 0 {
+		return nalus
+	}
+	return append(nalus, nalu)
+}
+
+// accessUnit is a frame taken apart for the muxer.
+type accessUnit struct {
+	sps, pps []byte
+	key      bool
+	// avcc holds the slices, each preceded by its length
+	avcc []byte
+}
+
+func parseAccessUnit(data []byte) accessUnit {
+	var au accessUnit
+	for _, nalu := range SplitAnnexB(data) {
+		switch nalu[0] & 0x1f {
+		case naluSPS:
+			au.sps = nalu
+		case naluPPS:
+			au.pps = nalu
+		case naluAUD:
+		default:
+			if nalu[0]&0x1f == naluIDR {
+				au.key = true
+			}
+			var size [4]byte
+			binary.BigEndian.PutUint32(size[:], uint32(len(nalu)))
+			au.avcc = append(au.avcc, size[:]...)
+			au.avcc = append(au.avcc, nalu...)
+		}
+	}
+	return au
+}
@@ -0,0 +1,269 @@
+// Package fmp4 muxes the dongle's H.264 video and PCM audio into fragmented
+// MP4: an init segment describing the tracks, then moof and mdat fragments.
+// The output plays in ffmpeg based players and, video only, in browsers
+// through Media Source Extensions.
+package fmp4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// VideoTimescale is the time unit of video tracks, in ticks per second.
+const VideoTimescale = 90000
+
+// VideoConfig describes an H.264 track.
+type VideoConfig struct {
+	Width  int
+	Height int
+	SPS    []byte
+	PPS    []byte
+}
+
+// Codec is the RFC 6381 codec string, e.g. avc1.42c01f, for MSE and HLS.
+func (c VideoConfig) Codec() string {
+	if len(c.SPS) < 4 {
+		return "avc1"
+	}
+	return fmt.Sprintf("avc1.%02x%02x%02x", c.SPS[1], c.SPS[2], c.SPS[3])
+}
+
+// AudioConfig describes a track of signed 16 bit little endian PCM, as the
+// dongle sends it.
+type AudioConfig struct {
+	SampleRate int
+	Channels   int
+}
+
+// frameSize is the size of one sample of all channels.
+func (c AudioConfig) frameSize() int {
+	return 2 * c.Channels
+}
+
+// Track is a track of the init segment, either video or audio.
+type Track struct {
+	ID    uint32
+	Video *VideoConfig
+	Audio *AudioConfig
+}
+
+// Timescale is the time unit of the track's samples.
+func (t Track) Timescale() uint32 {
+	if t.Audio != nil {
+		return uint32(t.Audio.SampleRate)
+	}
+	return VideoTimescale
+}
+
+// Sample is a video frame in AVCC form, or a chunk of interleaved PCM whose
+// duration follows from its length.
+type Sample struct {
+	Duration uint32
+	Key      bool
+	Data     []byte
+}
+
+// Run is the samples of a track within a fragment, BaseTime being the
+// decode time of the first one in the track's timescale.
+type Run struct {
+	Track    Track
+	BaseTime uint64
+	Samples  []Sample
+}
+
+const (
+	// sample flags of trun and tfhd
+	keySampleFlags    = 0x02000000 // depends on no other sample
+	nonKeySampleFlags = 0x01010000 // depends on others, not a sync sample
+)
+
+var matrix = []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000}
+
+func box(typ string, children ...[]byte) []byte {
+	size := 8
+	for _, c := range children {
+		size += len(c)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, c := range children {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func fullBox(typ string, version byte, flags uint32, children ...[]byte) []byte {
+	head := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return box(typ, append([][]byte{head}, children...)...)
+}
+
+func u16(v uint16) []byte {
+	return []byte{byte(v >> 8), byte(v)}
+}
+
+func u32(v uint32) []byte {
+	return []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func u64(v uint64) []byte {
+	return append(u32(uint32(v>>32)), u32(uint32(v))...)
+}
+
+func zeros(n int) []byte {
+	return make([]byte, n)
+}
+
+func matrixBytes() []byte {
+	var b []byte
+	for _, v := range matrix {
+		b = append(b, u32(v)...)
+	}
+	return b
+}
+
+// InitSegment is the ftyp and moov boxes describing the tracks.
+func InitSegment(tracks []Track) []byte {
+	var next uint32 = 1
+	var traks, trexs [][]byte
+	for _, t := range tracks {
+		if t.ID >= next {
+			next = t.ID + 1
+		}
+		traks = append(traks, trak(t))
+		trexs = append(trexs, fullBox("trex", 0, 0, u32(t.ID), u32(1), u32(0), u32(0), u32(0)))
+	}
+	mvhd := fullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(1000), u32(0),
+		u32(0x00010000), u16(0x0100), zeros(10),
+		matrixBytes(), zeros(24), u32(next))
+	moov := append([][]byte{mvhd}, traks...)
+	moov = append(moov, box("mvex", trexs...))
+	ftyp := box("ftyp", []byte("iso5"), u32(512), []byte("iso5iso6mp41avc1"))
+	return append(ftyp, box("moov", moov...)...)
+}
+
+func trak(t Track) []byte {
+	var width, height uint32
+	var volume uint16
+	var handler, name string
+	var header, entry []byte
+	if t.Audio != nil {
+		volume = 0x0100
+		handler, name = "soun", "SoundHandler"
+		header = fullBox("smhd", 0, 0, u16(0), u16(0))
+		entry = sowt(*t.Audio)
+	} else {
+		width, height = uint32(t.Video.Width), uint32(t.Video.Height)
+		handler, name = "vide", "VideoHandler"
+		header = fullBox("vmhd", 0, 1, u16(0), zeros(6))
+		entry = avc1(*t.Video)
+	}
+
+	tkhd := fullBox("tkhd", 0, 3,
+		u32(0), u32(0), u32(t.ID), u32(0), u32(0), zeros(8),
+		u16(0), u16(0), u16(volume), u16(0), matrixBytes(),
+		u32(width<<16), u32(height<<16))
+	mdhd := fullBox("mdhd", 0, 0, u32(0), u32(0), u32(t.Timescale()), u32(0), u16(0x55c4), u16(0))
+	hdlr := fullBox("hdlr", 0, 0, u32(0), []byte(handler), zeros(12), []byte(name), []byte{0})
+	dinf := box("dinf", fullBox("dref", 0, 0, u32(1), fullBox("url ", 0, 1)))
+	stbl := box("stbl",
+		fullBox("stsd", 0, 0, u32(1), entry),
+		fullBox("stts", 0, 0, u32(0)),
+		fullBox("stsc", 0, 0, u32(0)),
+		fullBox("stsz", 0, 0, u32(0), u32(0)),
+		fullBox("stco", 0, 0, u32(0)))
+	return box("trak", tkhd, box("mdia", mdhd, hdlr, box("minf", header, dinf, stbl)))
+}
+
+func avc1(c VideoConfig) []byte {
+	avcC := []byte{1, 0x42, 0, 0x1f, 0xff, 0xe1}
+	if len(c.SPS) >= 4 {
+		copy(avcC[1:4], c.SPS[1:4])
+	}
+	avcC = append(avcC, u16(uint16(len(c.SPS)))...)
+	avcC = append(avcC, c.SPS...)
+	avcC = append(avcC, 1)
+	avcC = append(avcC, u16(uint16(len(c.PPS)))...)
+	avcC = append(avcC, c.PPS...)
+	return box("avc1",
+		zeros(6), u16(1), zeros(16),
+		u16(uint16(c.Width)), u16(uint16(c.Height)),
+		u32(0x00480000), u32(0x00480000), u32(0), u16(1),
+		zeros(32), u16(0x0018), u16(0xffff),
+		box("avcC", avcC))
+}
+
+// sowt is the QuickTime sample entry for little endian 16 bit PCM.
+func sowt(c AudioConfig) []byte {
+	return box("sowt",
+		zeros(6), u16(1), zeros(8),
+		u16(uint16(c.Channels)), u16(16), u16(0), u16(0),
+		u32(uint32(c.SampleRate)<<16))
+}
+
+// Fragment is a moof box with a traf per run and the mdat box holding the
+// samples, seq numbering the fragments of a stream from 1.
+func Fragment(seq uint32, runs []Run) []byte {
+	// the data offsets in trun depend on the size of moof, which does not
+	// depend on their values
+	moof := buildMoof(seq, runs, 0)
+	moof = buildMoof(seq, runs, len(moof)+8)
+	var data [][]byte
+	for _, run := range runs {
+		for _, s := range run.Samples {
+			data = append(data, s.Data)
+		}
+	}
+	return append(moof, box("mdat", data...)...)
+}
+
+func buildMoof(seq uint32, runs []Run, dataOffset int) []byte {
+	children := [][]byte{fullBox("mfhd", 0, 0, u32(seq))}
+	for _, run := range runs {
+		children = append(children, traf(run, dataOffset))
+		for _, s := range run.Samples {
+			dataOffset += len(s.Data)
+		}
+	}
+	return box("moof", children...)
+}
+
+func traf(run Run, dataOffset int) []byte {
+	const (
+		defaultBaseIsMoof     = 0x020000
+		defaultSampleDuration = 0x08
+		defaultSampleSize     = 0x10
+		defaultSampleFlags    = 0x20
+
+		dataOffsetPresent     = 0x001
+		sampleDurationPresent = 0x100
+		sampleSizePresent     = 0x200
+		sampleFlagsPresent    = 0x400
+	)
+	tfdt := fullBox("tfdt", 1, 0, u64(run.BaseTime))
+
+	if audio := run.Track.Audio; audio != nil {
+		// every PCM frame is a sample, described by the defaults
+		size := 0
+		for _, s := range run.Samples {
+			size += len(s.Data)
+		}
+		tfhd := fullBox("tfhd", 0, defaultBaseIsMoof|defaultSampleDuration|defaultSampleSize|defaultSampleFlags,
+			u32(run.Track.ID), u32(1), u32(uint32(audio.frameSize())), u32(keySampleFlags))
+		trun := fullBox("trun", 0, dataOffsetPresent, u32(uint32(size/audio.frameSize())), u32(uint32(dataOffset)))
+		return box("traf", tfhd, tfdt, trun)
+	}
+
+	tfhd := fullBox("tfhd", 0, defaultBaseIsMoof, u32(run.Track.ID))
+	entries := [][]byte{u32(uint32(len(run.Samples))), u32(uint32(dataOffset))}
+	for _, s := range run.Samples {
+		flags := uint32(nonKeySampleFlags)
+		if s.Key {
+			flags = keySampleFlags
+		}
+		entries = append(entries, u32(s.Duration), u32(uint32(len(s.Data))), u32(flags))
+	}
+	trun := fullBox("trun", 0, dataOffsetPresent|sampleDurationPresent|sampleSizePresent|sampleFlagsPresent, entries...)
+	return box("traf", tfhd, tfdt, trun)
+}
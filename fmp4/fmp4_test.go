@@ -0,0 +1,153 @@
+package fmp4
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+var (
+	sps      = []byte{0x67, 0x42, 0xc0, 0x1f, 0xda, 0x01}
+	pps      = []byte{0x68, 0xce, 0x3c, 0x80}
+	idr      = []byte{0x65, 0x88, 0x84, 0x00, 0x33}
+	slice    = []byte{0x41, 0x9a, 0x02}
+	keyFrame = bytes.Join([][]byte{nil, sps, pps, idr}, []byte{0, 0, 0, 1})
+	frame    = append([]byte{0, 0, 0, 1}, slice...)
+)
+
+// boxes splits data into its top level boxes.
+func boxes(t *testing.T, data []byte) map[string][][]byte {
+	found := make(map[string][][]byte)
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("%d bytes left after the last box", len(data))
+		}
+		size := binary.BigEndian.Uint32(data)
+		if size < 8 || int(size) > len(data) {
+			t.Fatalf("box %q of size %d in %d bytes", data[4:8], size, len(data))
+		}
+		typ := string(data[4:8])
+		found[typ] = append(found[typ], data[8:size])
+		data = data[size:]
+	}
+	return found
+}
+
+func TestSplitAnnexB(t *testing.T) {
+	data := append(append(append([]byte{0, 0, 0, 1}, sps...), 0, 0, 1), pps...)
+	nalus := SplitAnnexB(data)
+	if len(nalus) != 2 || !bytes.Equal(nalus[0], sps) || !bytes.Equal(nalus[1], pps) {
+		t.Fatalf("SplitAnnexB = %x", nalus)
+	}
+}
+
+func TestInitSegment(t *testing.T) {
+	video := VideoConfig{Width: 800, Height: 480, SPS: sps, PPS: pps}
+	if codec := video.Codec(); codec != "avc1.42c01f" {
+		t.Errorf("codec %s", codec)
+	}
+	init := InitSegment([]Track{{ID: 1, Video: &video}, {ID: 2, Audio: &AudioConfig{SampleRate: 44100, Channels: 2}}})
+	top := boxes(t, init)
+	if len(top["ftyp"]) != 1 || len(top["moov"]) != 1 {
+		t.Fatalf("init segment boxes %v", top)
+	}
+	moov := boxes(t, top["moov"][0])
+	if len(moov["trak"]) != 2 || len(moov["mvex"]) != 1 || len(boxes(t, moov["mvex"][0])["trex"]) != 2 {
+		t.Fatal("want two tracks with their trex")
+	}
+	if !bytes.Contains(moov["trak"][0], append([]byte("avcC\x01"), sps[1:4]...)) {
+		t.Error("avcC does not carry the SPS profile")
+	}
+	if !bytes.Contains(moov["trak"][1], []byte("sowt")) {
+		t.Error("audio track is not sowt")
+	}
+}
+
+func TestFragmentDataOffset(t *testing.T) {
+	track := Track{ID: 1, Video: &VideoConfig{}}
+	samples := []Sample{{Duration: 3000, Key: true, Data: []byte("first")}, {Duration: 3000, Data: []byte("second")}}
+	frag := Fragment(7, []Run{{Track: track, BaseTime: 9000, Samples: samples}})
+	top := boxes(t, frag)
+	moof, mdat := top["moof"][0], top["mdat"][0]
+	if !bytes.Equal(mdat, []byte("firstsecond")) {
+		t.Fatalf("mdat %q", mdat)
+	}
+	traf := boxes(t, boxes(t, moof)["traf"][0])
+	trun := traf["trun"][0]
+	if n := binary.BigEndian.Uint32(trun[4:]); n != 2 {
+		t.Fatalf("trun has %d samples", n)
+	}
+	// the offset counts from the start of moof to the first sample
+	if offset := binary.BigEndian.Uint32(trun[8:]); int(offset) != len(moof)+8+8 {
+		t.Fatalf("data offset %d, want %d", offset, len(moof)+16)
+	}
+	if base := binary.BigEndian.Uint64(traf["tfdt"][0][4:]); base != 9000 {
+		t.Fatalf("base decode time %d", base)
+	}
+}
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, []AudioConfig{{SampleRate: 8000, Channels: 1}})
+	start := time.Unix(1700000000, 0)
+
+	// nothing before a keyframe
+	w.WriteVideo(start, frame, 800, 480)
+	w.WriteAudio(0, start, make([]byte, 160))
+	if out.Len() != 0 || w.Started() {
+		t.Fatal("wrote before the first keyframe")
+	}
+	for i := 0; i < 40; i++ {
+		f := frame
+		if i == 0 {
+			f = keyFrame
+		}
+		if err := w.WriteVideo(start.Add(time.Duration(i)*time.Second/30), f, 800, 480); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.WriteAudio(0, start.Add(time.Second), make([]byte, 160))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	top := boxes(t, out.Bytes())
+	if len(top["ftyp"]) != 1 || len(top["moov"]) != 1 || len(top["moof"]) < 2 || len(top["moof"]) != len(top["mdat"]) {
+		t.Fatalf("unexpected stream layout: %d moof, %d mdat", len(top["moof"]), len(top["mdat"]))
+	}
+
+	other := append([]byte{0, 0, 0, 1, 0x67, 0x64, 0, 0x28, 0, 0, 0, 1}, keyFrame[len(sps)+4:]...)
+	if err := w.WriteVideo(start.Add(2*time.Second), other, 800, 480); err != ErrVideoChanged {
+		t.Fatalf("new SPS: %v, want ErrVideoChanged", err)
+	}
+}
+
+func TestLiveWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out, nil)
+	w.Live = true
+	w.FrameDuration = 100 * time.Millisecond
+	start := time.Unix(1700000000, 0)
+	// the second frame comes before the first one ends, the third after a pause
+	for _, at := range []time.Duration{0, 10 * time.Millisecond, 2 * time.Second} {
+		f := frame
+		if at == 0 {
+			f = keyFrame
+		}
+		if err := w.WriteVideo(start.Add(at), f, 800, 480); err != nil {
+			t.Fatal(err)
+		}
+	}
+	top := boxes(t, out.Bytes())
+	if len(top["moof"]) != 3 {
+		t.Fatalf("%d fragments, want one per frame", len(top["moof"]))
+	}
+	var bases []uint64
+	for _, moof := range top["moof"] {
+		traf := boxes(t, boxes(t, moof)["traf"][0])
+		bases = append(bases, binary.BigEndian.Uint64(traf["tfdt"][0][4:]))
+	}
+	if bases[0] != 0 || bases[1] != 9000 || bases[2] != 2*VideoTimescale {
+		t.Fatalf("decode times %v", bases)
+	}
+}
@@ -0,0 +1,242 @@
+package fmp4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"time"
+)
+
+// FragmentDuration is how much media a fragment holds at most. Fragments
+// also end at keyframes.
+const FragmentDuration = time.Second
+
+// audioGap is how far audio may run behind the clock before the gap is
+// filled with silence; the dongle sends nothing while nothing plays.
+const audioGap = 100 * time.Millisecond
+
+// ErrVideoChanged is returned for a keyframe whose parameter sets or size
+// differ from those of the init segment. The caller closes the writer and
+// writes the frame to a new one.
+var ErrVideoChanged = errors.New("fmp4: video format changed")
+
+// Writer muxes live video and audio into a fragmented MP4 stream, timing the
+// frames by their arrival. Nothing is written before the first keyframe with
+// its SPS and PPS, the video track is track 1 and the audio tracks follow in
+// the order given to NewWriter.
+type Writer struct {
+	// Live writes every frame as a fragment of its own as it arrives, for
+	// players showing the stream as it comes. A frame then lasts
+	// FrameDuration and starts when it arrived, or when the frame before it
+	// ends if that is later.
+	Live          bool
+	FrameDuration time.Duration
+
+	// MaxDuration ends a fragment once it holds that much media,
+	// FragmentDuration when zero.
+	MaxDuration time.Duration
+
+	w      io.Writer
+	audio  []AudioConfig
+	tracks []Track
+	seq    uint32
+	start  time.Time
+	err    error
+
+	// latest parameter sets, a keyframe may come without them
+	sps, pps []byte
+
+	frame     *Sample
+	frameTime time.Time
+	video     []Sample
+	videoBase uint64
+	videoLen  uint64
+
+	pcm       [][]byte
+	audioBase []uint64
+	audioLen  []uint64
+}
+
+// NewWriter creates a writer with one video track and the given audio
+// tracks.
+func NewWriter(w io.Writer, audio []AudioConfig) *Writer {
+	return &Writer{
+		w:         w,
+		audio:     audio,
+		pcm:       make([][]byte, len(audio)),
+		audioBase: make([]uint64, len(audio)),
+		audioLen:  make([]uint64, len(audio)),
+	}
+}
+
+// Started reports whether the init segment was written.
+func (w *Writer) Started() bool {
+	return w.tracks != nil
+}
+
+// Video is the video track, once started.
+func (w *Writer) Video() *VideoConfig {
+	if w.tracks == nil {
+		return nil
+	}
+	return w.tracks[0].Video
+}
+
+// WriteVideo adds an Annex-B frame received at t.
+func (w *Writer) WriteVideo(t time.Time, frame []byte, width, height int) error {
+	if w.err != nil {
+		return w.err
+	}
+	au := parseAccessUnit(frame)
+	if au.sps != nil {
+		w.sps = au.sps
+	}
+	if au.pps != nil {
+		w.pps = au.pps
+	}
+
+	if w.tracks == nil {
+		if !au.key || w.sps == nil || w.pps == nil {
+			return nil
+		}
+		w.begin(t, VideoConfig{Width: width, Height: height, SPS: w.sps, PPS: w.pps})
+	} else if video := w.tracks[0].Video; au.key && (!bytes.Equal(w.sps, video.SPS) || !bytes.Equal(w.pps, video.PPS) || width != video.Width || height != video.Height) {
+		return ErrVideoChanged
+	}
+	if len(au.avcc) == 0 {
+		return w.err
+	}
+	if w.Live {
+		w.writeLive(t, Sample{Key: au.key, Data: au.avcc})
+		return w.err
+	}
+
+	if w.frame != nil {
+		w.frame.Duration = w.ticks(t.Sub(w.frameTime))
+		w.video = append(w.video, *w.frame)
+		w.videoLen += uint64(w.frame.Duration)
+		if au.key || w.videoLen >= uint64(w.ticks(w.maxDuration())) {
+			w.flush()
+		}
+	}
+	w.frame = &Sample{Key: au.key, Data: au.avcc}
+	w.frameTime = t
+	return w.err
+}
+
+func (w *Writer) writeLive(t time.Time, sample Sample) {
+	duration := w.FrameDuration
+	if duration <= 0 {
+		duration = time.Second / 30
+	}
+	sample.Duration = w.ticks(duration)
+	base := uint64(t.Sub(w.start)) * VideoTimescale / uint64(time.Second)
+	if base < w.videoBase {
+		base = w.videoBase
+	}
+	w.videoBase = base + uint64(sample.Duration)
+	w.seq++
+	_, w.err = w.w.Write(Fragment(w.seq, []Run{{Track: w.tracks[0], BaseTime: base, Samples: []Sample{sample}}}))
+}
+
+func (w *Writer) begin(t time.Time, video VideoConfig) {
+	w.start = t
+	w.tracks = []Track{{ID: 1, Video: &video}}
+	for i := range w.audio {
+		w.tracks = append(w.tracks, Track{ID: uint32(i + 2), Audio: &w.audio[i]})
+	}
+	_, w.err = w.w.Write(InitSegment(w.tracks))
+}
+
+func (w *Writer) maxDuration() time.Duration {
+	if w.MaxDuration > 0 {
+		return w.MaxDuration
+	}
+	return FragmentDuration
+}
+
+// ticks converts a duration to the video timescale, a frame lasting at
+// least one tick.
+func (w *Writer) ticks(d time.Duration) uint32 {
+	ticks := uint64(d) * VideoTimescale / uint64(time.Second)
+	if d < 0 || ticks == 0 {
+		return 1
+	}
+	return uint32(ticks)
+}
+
+// WriteAudio adds PCM of the given audio track received at t. Audio before
+// the first video frame is dropped.
+func (w *Writer) WriteAudio(track int, t time.Time, pcm []byte) error {
+	if w.err != nil || w.tracks == nil || track < 0 || track >= len(w.audio) {
+		return w.err
+	}
+	cfg := w.audio[track]
+	frames := uint64(len(pcm) / cfg.frameSize())
+	if frames == 0 {
+		return nil
+	}
+	pcm = pcm[:frames*uint64(cfg.frameSize())]
+
+	// the packet ends about now, pad the silence before it
+	end := w.audioBase[track] + w.audioLen[track]
+	if at := uint64(t.Sub(w.start)) * uint64(cfg.SampleRate) / uint64(time.Second); at > frames {
+		if due := at - frames; due > end+uint64(audioGap)*uint64(cfg.SampleRate)/uint64(time.Second) {
+			if w.audioLen[track] == 0 {
+				w.audioBase[track] = due
+			} else {
+				w.pcm[track] = append(w.pcm[track], make([]byte, (due-end)*uint64(cfg.frameSize()))...)
+				w.audioLen[track] += due - end
+			}
+		}
+	}
+	w.pcm[track] = append(w.pcm[track], pcm...)
+	w.audioLen[track] += frames
+	if w.audioLen[track] >= uint64(w.maxDuration())*uint64(cfg.SampleRate)/uint64(time.Second) {
+		w.flush()
+	}
+	return w.err
+}
+
+// flush writes the pending samples as a fragment.
+func (w *Writer) flush() {
+	var runs []Run
+	if len(w.video) > 0 {
+		runs = append(runs, Run{Track: w.tracks[0], BaseTime: w.videoBase, Samples: w.video})
+		w.videoBase += w.videoLen
+		w.video, w.videoLen = nil, 0
+	}
+	for i, pcm := range w.pcm {
+		if len(pcm) == 0 {
+			continue
+		}
+		runs = append(runs, Run{Track: w.tracks[i+1], BaseTime: w.audioBase[i], Samples: []Sample{{Data: pcm}}})
+		w.audioBase[i] += w.audioLen[i]
+		w.pcm[i], w.audioLen[i] = nil, 0
+	}
+	if len(runs) == 0 || w.err != nil {
+		return
+	}
+	w.seq++
+	_, w.err = w.w.Write(Fragment(w.seq, runs))
+}
+
+// Close writes what is pending, the last frame lasting as long as the one
+// before it. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil || w.tracks == nil {
+		return w.err
+	}
+	if w.frame != nil {
+		duration := uint32(VideoTimescale / 30)
+		if n := len(w.video); n > 0 {
+			duration = w.video[n-1].Duration
+		}
+		w.frame.Duration = duration
+		w.video = append(w.video, *w.frame)
+		w.videoLen += uint64(duration)
+		w.frame = nil
+	}
+	w.flush()
+	return w.err
+}
@@ -0,0 +1,80 @@
+package gnss
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// ValidSentence reports whether line is a complete NMEA 0183 sentence with a
+// correct checksum. Sentences without a checksum are accepted as is.
+func ValidSentence(line []byte) bool {
+	if len(line) < 6 || (line[0] != '$' && line[0] != '!') {
+		return false
+	}
+	star := bytes.LastIndexByte(line, '*')
+	if star < 0 {
+		return true
+	}
+	if len(line)-star != 3 {
+		return false
+	}
+	want, err := strconv.ParseUint(string(line[star+1:]), 16, 8)
+	if err != nil {
+		return false
+	}
+	var sum byte
+	for _, c := range line[1:star] {
+		sum ^= c
+	}
+	return sum == byte(want)
+}
+
+// sentenceType returns the talker-less sentence type ("RMC", "GGA", ...).
+func sentenceType(line []byte) string {
+	end := bytes.IndexByte(line, ',')
+	if end < 0 {
+		end = bytes.IndexByte(line, '*')
+	}
+	if end < 4 {
+		return ""
+	}
+	return string(line[end-3 : end])
+}
+
+// ReadEpochs reads NMEA sentences from r and calls fn with every complete fix
+// cycle, i.e. all sentences a receiver emits for one position update. The
+// cycle boundary is the first sentence type seen in the stream: whenever it
+// repeats, the previous cycle is complete. Lines that are not valid sentences
+// (gpsd JSON reports, garbage after a reconnect) are skipped. ReadEpochs
+// returns io.EOF once r is exhausted.
+func ReadEpochs(r io.Reader, fn func(epoch []byte)) error {
+	scanner := bufio.NewScanner(r)
+	var (
+		leader string
+		epoch  []byte
+	)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if !ValidSentence(line) {
+			continue
+		}
+		typ := sentenceType(line)
+		if leader == "" {
+			leader = typ
+		} else if typ == leader && len(epoch) > 0 {
+			fn(epoch)
+			epoch = nil
+		}
+		epoch = append(epoch, line...)
+		epoch = append(epoch, '\r', '\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if len(epoch) > 0 {
+		fn(epoch)
+	}
+	return io.EOF
+}
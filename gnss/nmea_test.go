@@ -0,0 +1,54 @@
+package gnss
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func checksum(sentence string) string {
+	var sum byte
+	for i := 1; i < len(sentence); i++ {
+		sum ^= sentence[i]
+	}
+	return fmt.Sprintf("%s*%02X", sentence, sum)
+}
+
+func TestValidSentence(t *testing.T) {
+	good := "$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W*6A"
+	if !ValidSentence([]byte(good)) {
+		t.Fatal("valid sentence rejected")
+	}
+	if ValidSentence([]byte(strings.Replace(good, "*6A", "*6B", 1))) {
+		t.Fatal("wrong checksum accepted")
+	}
+	if ValidSentence([]byte(`{"class":"VERSION"}`)) {
+		t.Fatal("gpsd report accepted")
+	}
+}
+
+func TestReadEpochs(t *testing.T) {
+	rmc := checksum("$GPRMC,123519,A,4807.038,N,01131.000,E,022.4,084.4,230394,003.1,W")
+	gga := checksum("$GPGGA,123519,4807.038,N,01131.000,E,1,08,0.9,545.4,M,46.9,M,,")
+	input := strings.Join([]string{
+		`{"class":"WATCH","enable":true,"nmea":true}`,
+		rmc, gga, rmc, gga, rmc,
+	}, "\n")
+
+	var epochs [][]byte
+	err := ReadEpochs(strings.NewReader(input), func(epoch []byte) {
+		epochs = append(epochs, epoch)
+	})
+	if err != io.EOF {
+		t.Fatal(err)
+	}
+	if len(epochs) != 3 {
+		t.Fatalf("got %d epochs, want 3", len(epochs))
+	}
+	want := rmc + "\r\n" + gga + "\r\n"
+	if !bytes.Equal(epochs[0], []byte(want)) {
+		t.Fatalf("epoch = %q, want %q", epochs[0], want)
+	}
+}
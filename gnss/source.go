@@ -0,0 +1,141 @@
+package gnss
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source is an open NMEA stream.
+type Source struct {
+	r io.ReadCloser
+	// replay is set for recorded logs, which are played back one fix cycle
+	// per interval instead of as fast as they can be read.
+	replay bool
+}
+
+// Open connects to the location source described by spec:
+//
+//	/dev/ttyUSB0, COM3        serial receiver (set the baud rate with stty or the driver)
+//	file:///path/track.nmea   recorded NMEA log, replayed in real time
+//	gpsd://host:2947          gpsd or a compatible server, NMEA watch mode
+//	tcp://host:port           raw NMEA over TCP
+func Open(spec string) (*Source, error) {
+	switch {
+	case spec == "":
+		return nil, errors.New("empty location source")
+	case strings.HasPrefix(spec, "file://"):
+		f, err := os.Open(strings.TrimPrefix(spec, "file://"))
+		if err != nil {
+			return nil, err
+		}
+		return &Source{r: f, replay: true}, nil
+	case strings.HasPrefix(spec, "gpsd://"):
+		conn, err := net.DialTimeout("tcp", strings.TrimPrefix(spec, "gpsd://"), 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.WriteString(conn, `?WATCH={"enable":true,"nmea":true};`+"\n"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return &Source{r: conn}, nil
+	case strings.HasPrefix(spec, "tcp://"):
+		conn, err := net.DialTimeout("tcp", strings.TrimPrefix(spec, "tcp://"), 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		return &Source{r: conn}, nil
+	}
+	f, err := os.Open(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &Source{r: f}, nil
+}
+
+func (s *Source) Close() error {
+	return s.r.Close()
+}
+
+// Forward reads fix cycles from the source and hands them to send, at most
+// one per interval. Live sources always deliver the latest cycle, stale ones
+// are dropped; recorded logs are paced so each cycle is sent once.
+// Forward returns when the source fails or, for logs, is exhausted.
+func (s *Source) Forward(interval time.Duration, send func([]byte)) error {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if s.replay {
+		return ReadEpochs(s.r, func(epoch []byte) {
+			send(epoch)
+			time.Sleep(interval)
+		})
+	}
+
+	var (
+		mu     sync.Mutex
+		latest []byte
+	)
+	done := make(chan error, 1)
+	go func() {
+		done <- ReadEpochs(s.r, func(epoch []byte) {
+			mu.Lock()
+			latest = epoch
+			mu.Unlock()
+		})
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			mu.Lock()
+			epoch := latest
+			latest = nil
+			mu.Unlock()
+			if epoch != nil {
+				send(epoch)
+			}
+		}
+	}
+}
+
+// Run keeps forwarding from spec until stop is closed, reopening the source
+// after failures (a replayed log simply starts over).
+func Run(spec string, interval time.Duration, send func([]byte), stop <-chan struct{}) {
+	for {
+		src, err := Open(spec)
+		if err != nil {
+			log.Printf("[gnss] %s: %s\n", spec, err)
+		} else {
+			closed := make(chan struct{})
+			go func() {
+				select {
+				case <-stop:
+					src.Close()
+				case <-closed:
+				}
+			}()
+			err = src.Forward(interval, send)
+			close(closed)
+			src.Close()
+			if err != io.EOF {
+				log.Printf("[gnss] %s: %s\n", spec, err)
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
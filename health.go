@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"webrtc/protocol"
+	"webrtc/usblink"
+)
+
+// onIncident publishes a link incident as an "incident" event. A reconnect
+// drops the phone session, so viewers see the dongle searching again.
+func (s *session) onIncident(incident usblink.Incident) {
+	s.events.publish("incident", incident)
+	if incident.Recovery >= usblink.RecoverReconnect {
+		s.status.setDongle(dongleSearching)
+		if s.status.get().Connection.State == "plugged" {
+			s.status.onData(&protocol.Unplugged{})
+			s.nowPlaying.clear()
+		}
+	}
+}
+
+// healthHandler reports the link health. POST {"recovery": "reset"} runs a
+// recovery by hand.
+func (s *session) healthHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		link := s.link()
+		if link == nil {
+			writeJSON(w, usblink.Health{})
+			return
+		}
+		writeJSON(w, link.Health())
+	case http.MethodPost:
+		var req struct {
+			Recovery string `json:"recovery"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		recovery, err := usblink.ParseRecovery(req.Recovery)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		link := s.link()
+		if link == nil {
+			writeError(w, http.StatusServiceUnavailable, errors.New("dongle is not started"))
+			return
+		}
+		if err := link.Recover(recovery); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET or POST"))
+	}
+}
+
+// usbHandler lists the attached dongles with their descriptors and the
+// layout the link would pick for each. Dongles in use name their session and
+// the layout it opened.
+func usbHandler(w http.ResponseWriter, r *http.Request) {
+	devices, err := usblink.Probe()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	type usbDevice struct {
+		usblink.DeviceInfo
+		Session string          `json:"session,omitempty"`
+		Active  *usblink.Layout `json:"active,omitempty"`
+	}
+	list := make([]usbDevice, 0, len(devices))
+	for _, dev := range devices {
+		entry := usbDevice{DeviceInfo: dev}
+		for _, s := range sessions {
+			link := s.link()
+			if link == nil {
+				continue
+			}
+			if health := link.Health(); health.Connected && health.Device == dev.Path {
+				entry.Session, entry.Active = s.name, health.Layout
+			}
+		}
+		list = append(list, entry)
+	}
+	writeJSON(w, list)
+}
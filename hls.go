@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+	"webrtc/hls"
+)
+
+// hlsIdle is how long the HLS stream of a session goes on without requests.
+const hlsIdle = 30 * time.Second
+
+// hlsHandler serves the session as Low-Latency HLS, the playlist being
+// /hls/index.m3u8. The stream starts with the first request, starting the
+// dongle if no viewer did, and stops after hlsIdle without requests.
+func (s *session) hlsHandler(w http.ResponseWriter, r *http.Request) {
+	s.hlsStream().ServeHTTP(w, r)
+}
+
+func (s *session) hlsStream() *hls.Stream {
+	s.hlsMu.Lock()
+	defer s.hlsMu.Unlock()
+	s.hlsUsed = time.Now()
+	if s.hls != nil {
+		return s.hls
+	}
+	log.Printf("[hls] %s: streaming\n", s.name)
+	s.hls = hls.NewStream(cfg.HLSPart, cfg.HLSSegment)
+	// on a running link the sink asks for the keyframe the stream starts
+	// at, otherwise the Open of the start brings one
+	s.addSink(s.hls)
+	s.startHeadless()
+	go s.stopIdleHLS(s.hls)
+	return s.hls
+}
+
+func (s *session) stopIdleHLS(stream *hls.Stream) {
+	ticker := time.NewTicker(hlsIdle / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.hlsMu.Lock()
+		idle := time.Since(s.hlsUsed) > hlsIdle
+		if idle {
+			s.hls = nil
+		}
+		s.hlsMu.Unlock()
+		if idle {
+			log.Printf("[hls] %s: no requests, stopping\n", s.name)
+			s.removeSink(stream)
+			stream.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// partSegments is how many of the last segments list their parts.
+const partSegments = 3
+
+// blockingPlaylist answers a playlist request. With _HLS_msn, and
+// _HLS_part, it waits for that segment or part first.
+func (s *Stream) blockingPlaylist(r *http.Request) ([]byte, string, int) {
+	query := r.URL.Query()
+	if query.Get("_HLS_msn") != "" {
+		msn, err := strconv.Atoi(query.Get("_HLS_msn"))
+		if err != nil || msn > s.nextMSN+1 {
+			return nil, "", http.StatusBadRequest
+		}
+		p := -1
+		if query.Get("_HLS_part") != "" {
+			if p, err = strconv.Atoi(query.Get("_HLS_part")); err != nil || p < 0 {
+				return nil, "", http.StatusBadRequest
+			}
+		}
+		s.wait(r, func() bool { return s.has(msn, p) })
+	}
+	// players want a complete segment in their first playlist
+	if !s.wait(r, func() bool { return len(s.segments) > 0 && s.segments[0].complete }) {
+		return nil, "", http.StatusServiceUnavailable
+	}
+	return s.playlist(), "application/vnd.apple.mpegurl", http.StatusOK
+}
+
+// playlist writes the rolling media playlist, the parts of the last
+// segments listed next to them and a hint at the part to come.
+func (s *Stream) playlist() []byte {
+	partTarget := s.partTarget
+	if s.maxPart > partTarget {
+		partTarget = s.maxPart
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:6\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", s.targetDuration()/time.Second)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", partTarget.Seconds())
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", s.segments[0].msn)
+	fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", s.segments[0].init-1)
+	for i, seg := range s.segments {
+		if i == 0 || seg.init != s.segments[i-1].init {
+			if i > 0 {
+				b.WriteString("#EXT-X-DISCONTINUITY\n")
+			}
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init%d.mp4\"\n", seg.init)
+		}
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", seg.start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		if i >= len(s.segments)-partSegments {
+			for p, part := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"part%d.%d.mp4\"", part.duration.Seconds(), seg.msn, p)
+				if part.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		if seg.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg%d.mp4\n", seg.duration.Seconds(), seg.msn)
+		}
+	}
+	if !s.closed {
+		msn, p := s.nextMSN, 0
+		if seg := s.current(); seg != nil {
+			msn, p = seg.msn, len(seg.parts)
+		}
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part%d.%d.mp4\"\n", msn, p)
+	}
+	return b.Bytes()
+}
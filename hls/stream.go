@@ -0,0 +1,320 @@
+// Package hls serves a live H.264 stream as Low-Latency HLS: fragmented MP4
+// segments beginning at keyframes, each made of short parts that players
+// fetch as they come, listed in a rolling playlist.
+package hls
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+	"webrtc/fmp4"
+	"webrtc/sink"
+)
+
+// keepSegments is how many complete segments the playlist lists.
+const keepSegments = 6
+
+// maxSegment caps a segment at that many segment targets when no keyframe
+// comes to end it; the next segment then starts without one.
+const maxSegment = 3
+
+type part struct {
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+type segment struct {
+	msn      int
+	init     int
+	start    time.Time
+	parts    []part
+	duration time.Duration
+	complete bool
+}
+
+// Stream is a sink turning the frames into the segments and parts of an
+// HLS stream, served by ServeHTTP as index.m3u8 with its media next to it.
+// A segment ends at the first keyframe after the segment target, a part
+// once it holds the part target of video. A change of the video format
+// begins a new init segment after a discontinuity.
+type Stream struct {
+	partTarget    time.Duration
+	segmentTarget time.Duration
+
+	mu         sync.Mutex
+	mux        *fmp4.Writer
+	inits      map[int][]byte
+	initSeq    int
+	expectInit bool
+	segments   []*segment
+	nextMSN    int
+	now        time.Time
+	partStart  time.Time
+	partKey    bool
+	maxPart    time.Duration
+	maxSeg     time.Duration
+	changed    chan struct{}
+	closed     bool
+	err        error
+}
+
+// NewStream creates a stream cutting parts of partTarget and segments of
+// about segmentTarget.
+func NewStream(partTarget, segmentTarget time.Duration) *Stream {
+	s := &Stream{
+		partTarget:    partTarget,
+		segmentTarget: segmentTarget,
+		inits:         make(map[int][]byte),
+		changed:       make(chan struct{}),
+	}
+	s.restart()
+	return s
+}
+
+// chunkWriter hands every write of the muxer, an init segment or a
+// fragment, to a function.
+type chunkWriter func(p []byte)
+
+func (c chunkWriter) Write(p []byte) (int, error) {
+	c(append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (s *Stream) restart() {
+	s.initSeq++
+	s.expectInit = true
+	s.mux = fmp4.NewWriter(chunkWriter(s.chunk), nil)
+	s.mux.MaxDuration = s.partTarget
+}
+
+func (s *Stream) Write(f sink.Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.err != nil {
+		return
+	}
+	s.now = f.Time
+	started := s.mux.Started()
+	err := s.mux.WriteVideo(f.Time, f.Data, f.Width, f.Height)
+	if err == fmp4.ErrVideoChanged {
+		// the frames written so far end the segment, the new format
+		// begins the next one
+		err = s.mux.Close()
+		s.endSegment()
+		s.restart()
+		started = false
+		if err == nil {
+			err = s.mux.WriteVideo(f.Time, f.Data, f.Width, f.Height)
+		}
+	}
+	if err != nil {
+		s.err = err
+		s.notify()
+		return
+	}
+	switch {
+	case !s.mux.Started():
+	case !started:
+		s.partStart, s.partKey = f.Time, true
+	case sink.KeyFrame(f.Data):
+		// the muxer wrote the frames before the keyframe as a part
+		s.partKey = true
+		if seg := s.current(); seg != nil && seg.duration >= s.segmentTarget {
+			s.endSegment()
+		}
+	}
+}
+
+// chunk takes a write of the muxer, the init segment after a restart and
+// then the parts.
+func (s *Stream) chunk(p []byte) {
+	if s.expectInit {
+		s.inits[s.initSeq] = p
+		s.expectInit = false
+		return
+	}
+	seg := s.current()
+	if seg == nil {
+		seg = &segment{msn: s.nextMSN, init: s.initSeq, start: s.partStart}
+		s.nextMSN++
+		s.segments = append(s.segments, seg)
+	}
+	duration := s.now.Sub(s.partStart)
+	seg.parts = append(seg.parts, part{data: p, duration: duration, independent: s.partKey})
+	seg.duration += duration
+	s.partStart, s.partKey = s.now, false
+	if duration > s.maxPart {
+		s.maxPart = duration
+	}
+	if seg.duration >= maxSegment*s.segmentTarget {
+		s.endSegment()
+	}
+	s.notify()
+}
+
+// current is the segment taking parts, nil between segments.
+func (s *Stream) current() *segment {
+	if n := len(s.segments); n > 0 && !s.segments[n-1].complete {
+		return s.segments[n-1]
+	}
+	return nil
+}
+
+func (s *Stream) endSegment() {
+	seg := s.current()
+	if seg == nil {
+		return
+	}
+	seg.complete = true
+	if seg.duration > s.maxSeg {
+		s.maxSeg = seg.duration
+	}
+	if n := len(s.segments) - keepSegments; n > 0 {
+		s.segments = append([]*segment{}, s.segments[n:]...)
+		for id := range s.inits {
+			if id < s.segments[0].init {
+				delete(s.inits, id)
+			}
+		}
+	}
+	s.notify()
+}
+
+// notify wakes the requests waiting for the stream to change.
+func (s *Stream) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// Close ends the stream, the waiting requests return.
+func (s *Stream) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.notify()
+	}
+	return nil
+}
+
+// targetDuration is the EXT-X-TARGETDURATION of the playlist, whole
+// seconds no segment rounds above.
+func (s *Stream) targetDuration() time.Duration {
+	target := s.segmentTarget
+	if s.maxSeg > target {
+		target = s.maxSeg
+	}
+	if target = target.Round(time.Second); target < time.Second {
+		target = time.Second
+	}
+	return target
+}
+
+// wait holds mu until ready or the stream ends, at most three target
+// durations as the LL-HLS blocking requests do.
+func (s *Stream) wait(r *http.Request, ready func() bool) bool {
+	timeout := time.NewTimer(3 * s.targetDuration())
+	defer timeout.Stop()
+	for !ready() && !s.closed && s.err == nil {
+		changed := s.changed
+		s.mu.Unlock()
+		select {
+		case <-changed:
+		case <-timeout.C:
+			s.mu.Lock()
+			return ready()
+		case <-r.Context().Done():
+			s.mu.Lock()
+			return false
+		}
+		s.mu.Lock()
+	}
+	return ready()
+}
+
+// has reports whether segment msn is complete or, with p not negative, has
+// part p.
+func (s *Stream) has(msn, p int) bool {
+	for i := len(s.segments) - 1; i >= 0; i-- {
+		seg := s.segments[i]
+		if seg.msn > msn {
+			return true
+		}
+		if seg.msn == msn {
+			return seg.complete || (p >= 0 && len(seg.parts) > p)
+		}
+	}
+	return false
+}
+
+func (s *Stream) find(msn int) *segment {
+	for _, seg := range s.segments {
+		if seg.msn == msn {
+			return seg
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the playlist, index.m3u8, and the init segments, segments
+// and parts it lists. The playlist blocks for the _HLS_msn and _HLS_part
+// query parameters, a part request for the part the playlist hints at.
+func (s *Stream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, contentType, code := s.lookup(r)
+	if code != http.StatusOK {
+		http.Error(w, http.StatusText(code), code)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// lookup finds the response to r, the lock is not held while it is sent.
+func (s *Stream) lookup(r *http.Request) ([]byte, string, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return nil, "", http.StatusInternalServerError
+	}
+
+	var msn, p, id int
+	name := path.Base(r.URL.Path)
+	switch {
+	case name == "index.m3u8":
+		return s.blockingPlaylist(r)
+	case scan(name, "init%d.mp4", &id):
+		if init, ok := s.inits[id]; ok {
+			return init, "video/mp4", http.StatusOK
+		}
+	case scan(name, "seg%d.mp4", &msn):
+		if seg := s.find(msn); seg != nil && seg.complete {
+			var data bytes.Buffer
+			for _, part := range seg.parts {
+				data.Write(part.data)
+			}
+			return data.Bytes(), "video/mp4", http.StatusOK
+		}
+	case scan(name, "part%d.%d.mp4", &msn, &p):
+		if msn > s.nextMSN {
+			break
+		}
+		s.wait(r, func() bool { return s.has(msn, p) })
+		if seg := s.find(msn); seg != nil && p < len(seg.parts) {
+			return seg.parts[p].data, "video/mp4", http.StatusOK
+		}
+	}
+	return nil, "", http.StatusNotFound
+}
+
+// scan parses name by format, the whole name.
+func scan(name, format string, args ...interface{}) bool {
+	var rest string
+	n, _ := fmt.Sscanf(name+" end", format+" %s", append(args, &rest)...)
+	return n == len(args)+1 && rest == "end"
+}
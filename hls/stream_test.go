@@ -0,0 +1,146 @@
+package hls
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	"webrtc/sink"
+)
+
+var (
+	keyFrame   = []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, 0xda, 0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80, 0, 0, 0, 1, 0x65, 0x88, 0x84}
+	deltaFrame = []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02}
+	start      = time.Unix(1700000000, 0)
+)
+
+// feed writes frames at 30 fps from frame first on, a keyframe every second.
+func feed(s *Stream, first, n int) {
+	for i := first; i < first+n; i++ {
+		data := deltaFrame
+		if i%30 == 0 {
+			data = keyFrame
+		}
+		s.Write(sink.Frame{Time: start.Add(time.Duration(i) * time.Second / 30), Width: 800, Height: 480, Data: data})
+	}
+}
+
+func get(t *testing.T, s *Stream, url string) (int, []byte) {
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	return rec.Code, rec.Body.Bytes()
+}
+
+func TestScan(t *testing.T) {
+	var msn, p int
+	if !scan("part12.3.mp4", "part%d.%d.mp4", &msn, &p) || msn != 12 || p != 3 {
+		t.Fatalf("part12.3.mp4 scanned as %d.%d", msn, p)
+	}
+	for _, name := range []string{"part12.mp4", "seg1.mp4x", "seg.mp4"} {
+		if scan(name, "seg%d.mp4", &msn) {
+			t.Errorf("%s scanned as a segment", name)
+		}
+	}
+}
+
+func TestPlaylist(t *testing.T) {
+	s := NewStream(200*time.Millisecond, time.Second)
+	feed(s, 0, 100)
+
+	code, body := get(t, s, "/hls/index.m3u8")
+	if code != http.StatusOK {
+		t.Fatalf("playlist: %d", code)
+	}
+	playlist := string(body)
+	for _, want := range []string{
+		"#EXT-X-TARGETDURATION:1\n",
+		"#EXT-X-MEDIA-SEQUENCE:0\n",
+		"#EXT-X-MAP:URI=\"init1.mp4\"\n",
+		"URI=\"part3.0.mp4\",INDEPENDENT=YES\n",
+		"#EXTINF:1.000,\nseg0.mp4\n",
+		"#EXTINF:1.000,\nseg2.mp4\n",
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part3.",
+	} {
+		if !strings.Contains(playlist, want) {
+			t.Errorf("playlist lacks %q:\n%s", want, playlist)
+		}
+	}
+	if strings.Contains(playlist, "seg3.mp4") {
+		t.Error("the open segment is listed as complete")
+	}
+	if strings.Contains(playlist, "part0.") {
+		t.Error("the parts of an old segment are listed")
+	}
+
+	for _, url := range []string{"/hls/init1.mp4", "/hls/seg1.mp4", "/hls/part3.0.mp4"} {
+		if code, body := get(t, s, url); code != http.StatusOK || len(body) == 0 {
+			t.Errorf("%s: %d, %d bytes", url, code, len(body))
+		}
+	}
+	_, seg := get(t, s, "/hls/seg1.mp4")
+	if !bytes.Contains(seg, []byte("moof")) || bytes.Contains(seg, []byte("moov")) {
+		t.Error("a segment is not made of fragments")
+	}
+	if code, _ := get(t, s, "/hls/seg9.mp4"); code != http.StatusNotFound {
+		t.Errorf("a future segment: %d", code)
+	}
+}
+
+func TestRollingWindow(t *testing.T) {
+	s := NewStream(200*time.Millisecond, time.Second)
+	feed(s, 0, 30*(keepSegments+3))
+	_, body := get(t, s, "/hls/index.m3u8")
+	if !strings.Contains(string(body), "#EXT-X-MEDIA-SEQUENCE:2\n") {
+		t.Fatalf("old segments kept:\n%s", body)
+	}
+	if code, _ := get(t, s, "/hls/seg0.mp4"); code != http.StatusNotFound {
+		t.Errorf("a dropped segment: %d", code)
+	}
+}
+
+func TestBlockingReload(t *testing.T) {
+	s := NewStream(200*time.Millisecond, time.Second)
+	feed(s, 0, 40)
+
+	done := make(chan string)
+	go func() {
+		_, body := get(t, s, "/hls/index.m3u8?_HLS_msn=1&_HLS_part=2")
+		done <- string(body)
+	}()
+	select {
+	case <-done:
+		t.Fatal("the playlist did not wait for the part")
+	case <-time.After(50 * time.Millisecond):
+	}
+	feed(s, 40, 20)
+	select {
+	case playlist := <-done:
+		if !strings.Contains(playlist, "part1.2.mp4") {
+			t.Fatalf("playlist without the part it waited for:\n%s", playlist)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the playlist still waits")
+	}
+
+	if code, _ := get(t, s, "/hls/index.m3u8?_HLS_msn=9"); code != http.StatusBadRequest {
+		t.Errorf("a far segment: %d", code)
+	}
+}
+
+func TestVideoChange(t *testing.T) {
+	s := NewStream(200*time.Millisecond, time.Second)
+	feed(s, 0, 45)
+	other := append([]byte{0, 0, 0, 1, 0x67, 0x64, 0, 0x28}, keyFrame[9:]...)
+	s.Write(sink.Frame{Time: start.Add(2 * time.Second), Width: 800, Height: 480, Data: other})
+	for i := 1; i < 40; i++ {
+		s.Write(sink.Frame{Time: start.Add(2*time.Second + time.Duration(i)*time.Second/30), Width: 800, Height: 480, Data: deltaFrame})
+	}
+	s.Write(sink.Frame{Time: start.Add(4 * time.Second), Width: 800, Height: 480, Data: other})
+
+	_, body := get(t, s, "/hls/index.m3u8")
+	if !strings.Contains(string(body), "#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"init2.mp4\"\n") {
+		t.Fatalf("no discontinuity at the new format:\n%s", body)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// defaultICEServer is used without -ice-server outside of -lan mode.
+const defaultICEServer = "stun:stun.l.google.com:19302"
+
+// parseICEServer parses an -ice-server value, a stun:, turn: or turns: URL
+// with the credentials of a TURN server in front as user:password@.
+func parseICEServer(value string) (webrtc.ICEServer, error) {
+	server := webrtc.ICEServer{URLs: []string{value}}
+	for _, scheme := range []string{"@stun:", "@turn:", "@turns:"} {
+		if i := strings.LastIndex(value, scheme); i >= 0 {
+			user := strings.SplitN(value[:i], ":", 2)
+			if len(user) != 2 {
+				return server, fmt.Errorf("ICE server credentials %q are not user:password", value[:i])
+			}
+			server = webrtc.ICEServer{URLs: []string{value[i+1:]}, Username: user[0], Credential: user[1]}
+			break
+		}
+	}
+	if _, err := ice.ParseURL(server.URLs[0]); err != nil {
+		return server, fmt.Errorf("ICE server %q: %w", server.URLs[0], err)
+	}
+	return server, nil
+}
+
+// parsePortRange parses an -udp-ports value, min-max.
+func parsePortRange(value string) (uint16, uint16, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("UDP port range %q is not min-max", value)
+	}
+	min, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.ParseUint(bounds[1], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if min == 0 || min > max {
+		return 0, 0, fmt.Errorf("UDP port range %q is empty", value)
+	}
+	return uint16(min), uint16(max), nil
+}
+
+var mdnsModes = map[string]ice.MulticastDNSMode{
+	"off":    ice.MulticastDNSModeDisabled,
+	"query":  ice.MulticastDNSModeQueryOnly,
+	"gather": ice.MulticastDNSModeQueryAndGather,
+}
+
+var (
+	webrtcOnce sync.Once
+	webrtcAPI  *webrtc.API
+	webrtcErr  error
+)
+
+// sharedWebRTCAPI is the API all peer connections are created with, built
+// on the first call.
+func sharedWebRTCAPI() (*webrtc.API, error) {
+	webrtcOnce.Do(func() {
+		webrtcAPI, webrtcErr = newWebRTCAPI()
+	})
+	return webrtcAPI, webrtcErr
+}
+
+// newPeerConnection creates a peer connection for a viewer.
+func newPeerConnection() (*webrtc.PeerConnection, error) {
+	api, err := sharedWebRTCAPI()
+	if err != nil {
+		return nil, err
+	}
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{ICEServers: cfg.ICEServers})
+	if err != nil {
+		return nil, err
+	}
+
+	stats, ok := pc.GetStats().GetConnectionStats(pc)
+	if !ok {
+		stats.ID = "unknoown"
+	}
+
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Printf("State of %s: %s \n", stats.ID, connectionState.String())
+	})
+	return pc, nil
+}
+
+// newWebRTCAPI applies the ICE flags to the API, the peer connections
+// share the -udp-mux socket.
+func newWebRTCAPI() (*webrtc.API, error) {
+	mediaEngine := webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+
+	var settings webrtc.SettingEngine
+	settings.SetICEMulticastDNSMode(cfg.MDNS)
+	if cfg.LAN {
+		settings.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4, webrtc.NetworkTypeUDP6})
+	}
+	if cfg.UDPPortMin != 0 {
+		if err := settings.SetEphemeralUDPPortRange(cfg.UDPPortMin, cfg.UDPPortMax); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.UDPMux != "" {
+		addr, err := net.ResolveUDPAddr("udp", cfg.UDPMux)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("WebRTC media on UDP %s\n", conn.LocalAddr())
+		settings.SetICEUDPMux(webrtc.NewICEUDPMux(nil, conn))
+	}
+	if len(cfg.NATIPs) > 0 {
+		settings.SetNAT1To1IPs(cfg.NATIPs, webrtc.ICECandidateTypeHost)
+	}
+	return webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine), webrtc.WithSettingEngine(settings)), nil
+}
+
+// checkICE reports a conflict between the ICE flags of c.
+func checkICE(c config) error {
+	if c.LAN && len(c.ICEServers) > 0 {
+		return errors.New("-lan uses no ICE servers, leave out -ice-server")
+	}
+	if c.UDPMux != "" && c.UDPPortMin != 0 {
+		return errors.New("use either -udp-mux or -udp-ports")
+	}
+	if c.TURN != "" && c.UDPMux == "" && c.UDPPortMin == 0 {
+		// the relay would reach every UDP port of this host
+		return errors.New("-turn relays to the peer connections only, set -udp-mux or -udp-ports")
+	}
+	if len(c.NATIPs) > 0 && c.MDNS == ice.MulticastDNSModeQueryAndGather {
+		return errors.New("-nat-ip replaces the host addresses that -mdns gather hides, use one of them")
+	}
+	return nil
+}
+
+// viewerICEServers are the ICE servers for a viewer, the embedded TURN
+// server with fresh credentials among them.
+func viewerICEServers() []webrtc.ICEServer {
+	servers := append([]webrtc.ICEServer{}, cfg.ICEServers...)
+	if server, ok := turnICEServer(); ok {
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// iceHandler lists the ICE servers for viewers signalling over /connect.
+func iceHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{"iceServers": viewerICEServers()})
+}
+
+// iceLinks announces the ICE servers in Link headers, as WHEP does.
+func iceLinks(w http.ResponseWriter) {
+	for _, server := range viewerICEServers() {
+		for _, url := range server.URLs {
+			link := fmt.Sprintf("<%s>; rel=\"ice-server\"", url)
+			if server.Username != "" {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", server.Username, server.Credential)
+			}
+			w.Header().Add("Link", link)
+		}
+	}
+}
@@ -1,5 +1,11 @@
 const video = document.querySelector("video");
 
+// without WebRTC the WebSocket page takes over
+const useWebSocket = () => location.replace("mse.html" + location.search);
+if (typeof RTCPeerConnection == "undefined") {
+  useWebSocket();
+}
+
 var last_media_time, last_frame_num, fps;
 var fps_rounder = [];
 var frame_not_seeked = true;
@@ -36,13 +42,8 @@ function get_fps_average() {
   return fps_rounder.reduce((a, b) => a + b) / fps_rounder.length;
 }
 
-const pc = new RTCPeerConnection({
-  iceServers: [
-    {
-      urls: "stun:stun.l.google.com:19302",
-    },
-  ],
-});
+// the ICE servers come with the signalling
+const pc = new RTCPeerConnection();
 
 pc.ontrack = (event) => {
   if (video.srcObject == null) {
@@ -52,36 +53,78 @@ pc.ontrack = (event) => {
   }
 };
 
+const viewerSize = () => ({
+  width: (video.clientWidth * devicePixelRatio) | 0,
+  height: (video.clientHeight * devicePixelRatio) | 0,
+});
+
 const startData = pc.createDataChannel("start");
-startData.onopen = () => startData.send(
-  JSON.stringify({
-    width: (960 * devicePixelRatio) | 0,
-    height: (360 * devicePixelRatio) | 0,
-  })
-);
+startData.onopen = () => startData.send(JSON.stringify(viewerSize()));
 
-pc.oniceconnectionstatechange = () => {
-  console.log("connection:", pc.iceConnectionState);
+const resizeData = pc.createDataChannel("resize");
+new ResizeObserver(() => {
+  if (resizeData.readyState == "open") {
+    resizeData.send(JSON.stringify(viewerSize()));
+  }
+}).observe(video);
+
+// the signalling trickles the candidates both ways; the offers, the first
+// one and those renegotiating or restarting ICE, always come from here
+const signalURL = new URL("signal", location.href);
+signalURL.protocol = location.protocol == "https:" ? "wss:" : "ws:";
+const signal = new WebSocket(signalURL);
+const signalOpen = new Promise((resolve) => (signal.onopen = resolve));
+const sendSignal = (msg) => signalOpen.then(() => signal.send(JSON.stringify(msg)));
+
+let configured;
+const configuration = new Promise((resolve) => (configured = resolve));
+
+signal.onmessage = (e) => {
+  const { type, sdp, candidate, message, iceServers } = JSON.parse(e.data);
+  switch (type) {
+    case "config":
+      pc.setConfiguration({ ...pc.getConfiguration(), iceServers });
+      configured();
+      break;
+    case "answer":
+      pc.setRemoteDescription({ type, sdp }).catch(console.error);
+      break;
+    case "candidate":
+      if (candidate) {
+        pc.addIceCandidate(candidate).catch(console.error);
+      }
+      break;
+    case "error":
+      console.error("signalling:", message);
+      break;
+  }
+};
+
+pc.onnegotiationneeded = () => {
+  configuration
+    .then(() => pc.setLocalDescription())
+    .then(() => sendSignal({ type: "offer", sdp: pc.localDescription.sdp }))
+    .catch(console.error);
+};
+
+pc.onicecandidate = ({ candidate }) => {
+  sendSignal({ type: "candidate", candidate: candidate && candidate.toJSON() });
 };
 
-pc.onicecandidate = (event) => {
-  if (event.candidate == null) {
-    fetch("/connect", {
-      method: "POST",
-      body: JSON.stringify(pc.localDescription),
-    })
-      .then((res) => Promise.all([res.json(), res.ok]))
-      .then(([answer, ok]) => {
-        if (!ok) {
-          return Promise.reject(answer);
-        }
-        try {
-          pc.setRemoteDescription(new RTCSessionDescription(answer));
-        } catch (e) {
-          Promise.reject(e);
-        }
-      })
-      .catch(console.error);
+// a failed connection gets one ICE restart before the WebSocket page
+// takes over
+let restarted = false;
+pc.oniceconnectionstatechange = () => {
+  console.log("connection:", pc.iceConnectionState);
+  if (pc.iceConnectionState == "connected") {
+    restarted = false;
+  } else if (pc.iceConnectionState == "failed") {
+    if (restarted) {
+      useWebSocket();
+    } else {
+      restarted = true;
+      pc.restartIce();
+    }
   }
 };
 
@@ -115,6 +158,49 @@ pc.ondatachannel = ({ channel: dc }) => {
       src.connect(audioCtx.destination);
       src.start();
     };
+  } else if (dc.label == "status") {
+    const overlay = document.querySelector("#overlay");
+    let dongle = "stopped";
+    let phone = "unplugged";
+    const render = () => {
+      if (dongle != "ready") {
+        overlay.textContent = "Connecting to the dongle...";
+      } else if (phone != "plugged") {
+        overlay.textContent = "Phone disconnected";
+      }
+      overlay.hidden = dongle == "ready" && phone == "plugged";
+    };
+    dc.onmessage = (e) => {
+      const { type, data } = JSON.parse(e.data);
+      switch (type) {
+        case "dongle":
+          dongle = data.state;
+          break;
+        case "phone":
+          phone = data.state;
+          break;
+        case "video":
+          console.log("video size:", data.width, data.height);
+          break;
+        case "error":
+          console.error("dongle:", data.message);
+          break;
+        case "incident":
+          console.warn("link incident:", data.kind, data.detail || "", "recovery:", data.recovery);
+          break;
+      }
+      render();
+    };
+  } else if (dc.label == "nowplaying") {
+    const panel = document.querySelector("#nowplaying");
+    dc.onmessage = (e) => {
+      const { data } = JSON.parse(e.data);
+      panel.querySelector("img").src = data.albumArt || "";
+      panel.querySelector("img").hidden = !data.albumArt;
+      panel.querySelector("span").textContent = [data.title, data.artist, data.album]
+        .filter((s) => s)
+        .join(" - ");
+    };
   }
 };
 
@@ -145,6 +231,7 @@ const sendTouchEvent = ({ type, offsetX, offsetY }) => {
     x: (offsetX * devicePixelRatio) | 0,
     y: (offsetY * devicePixelRatio) | 0,
     action,
+    ...viewerSize(),
   };
   touchData.send(JSON.stringify(data));
 };
@@ -154,7 +241,3 @@ video.addEventListener("pointermove", sendTouchEvent);
 video.addEventListener("pointerup", sendTouchEvent);
 video.addEventListener("pointercancel", sendTouchEvent);
 video.addEventListener("pointerout", sendTouchEvent);
-
-pc.createOffer()
-  .then((d) => pc.setLocalDescription(d))
-  .catch(console.error);
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"webrtc/capture"
+	"webrtc/protocol"
+	"webrtc/usblink"
+)
+
+// dongleLink is what a session talks to: the USB link to a real dongle, or
+// the replay and emulator links of the debugging commands.
+type dongleLink interface {
+	Start(onReadySend func(), onVideo func(protocol.VideoData), onAudio func(protocol.AudioData), onData func(interface{}), onError func(error)) error
+	Stop()
+	SendMessage(msg interface{}) error
+	SendMessageWait(msg interface{}) error
+	Health() usblink.Health
+	Recover(r usblink.Recovery) error
+}
+
+// linkCallbacks are the callbacks given to Start, for links that produce
+// decoded messages themselves.
+type linkCallbacks struct {
+	onReadySend func()
+	onVideo     func(protocol.VideoData)
+	onAudio     func(protocol.AudioData)
+	onData      func(interface{})
+	onError     func(error)
+}
+
+// deliver hands a message decoded by protocol.Decode to the right callback.
+func (c linkCallbacks) deliver(msg interface{}) {
+	switch msg := msg.(type) {
+	case protocol.VideoData:
+		c.onVideo(msg)
+	case protocol.AudioData:
+		c.onAudio(msg)
+	default:
+		c.onData(msg)
+	}
+}
+
+// openLink creates the link of a session, a USB link unless the command
+// running the session brought its own.
+func (s *session) openLink() dongleLink {
+	if s.newLink != nil {
+		return s.newLink()
+	}
+	return &usblink.USBLink{
+		Device:      s.device,
+		BatchWindow: cfg.USBBatch,
+		Watchdog:    cfg.Watchdog,
+		OnIncident:  s.onIncident,
+		Tap:         s.tap,
+	}
+}
+
+// tap writes the traffic of the USB link to the session's recorder.
+func (s *session) tap(incoming bool, data []byte) {
+	if s.recorder == nil {
+		return
+	}
+	dir := capture.Out
+	if incoming {
+		dir = capture.In
+	}
+	s.recorder.Write(dir, data)
+}
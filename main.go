@@ -7,9 +7,11 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"os"
 	"time"
 	"webrtc/protocol"
-	"webrtc/usblink"
+	"webrtc/sink"
+	"webrtc/touch"
 
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
@@ -20,65 +22,120 @@ type deviceSize struct {
 	Height int32 `json:"height"`
 }
 
+// deviceTouch is a pointer event in viewer pixels. Width and Height are the
+// viewer size the event refers to; older clients leave them out.
 type deviceTouch struct {
 	X      float32 `json:"x"`
 	Y      float32 `json:"y"`
 	Action int32   `json:"action"`
+	Width  float32 `json:"width,omitempty"`
+	Height float32 `json:"height,omitempty"`
 }
 
 var (
-	videoTrack       *webrtc.TrackLocalStaticSample
-	audioDataChannel *webrtc.DataChannel
-	size             deviceSize
-	fps              int32 = 30
-	usbLink          *usblink.USBLink
+	cfg config
+	fps int32 = 30
 )
 
-func setupWebRTC(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
-	// WebRTC setup
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
+// track is the video track of stream, shared by the viewers' peer
+// connections: the main CarPlay screen, or "navi" for the instrument
+// cluster stream.
+func (s *session) track(stream string) (*webrtc.TrackLocalStaticSample, error) {
+	s.tracksMu.Lock()
+	defer s.tracksMu.Unlock()
+	videoCodec := webrtc.RTPCodecCapability{
+		MimeType:  webrtc.MimeTypeH264,
+		ClockRate: 90000,
+		Channels:  0,
+		//SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032",
+		SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f",
+		RTCPFeedback: nil,
 	}
-	mediaEngine := webrtc.MediaEngine{}
-
-	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
-		return nil, err
+	var err error
+	if stream == "navi" {
+		if s.naviTrack == nil {
+			s.naviTrack, err = webrtc.NewTrackLocalStaticSample(videoCodec, "navi", "navi")
+		}
+		return s.naviTrack, err
 	}
+	if s.videoTrack == nil {
+		s.videoTrack, err = webrtc.NewTrackLocalStaticSample(videoCodec, "video", "video")
+	}
+	return s.videoTrack, err
+}
 
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(&mediaEngine))
+// sharedTrack returns the video track of stream once a viewer created it.
+func (s *session) sharedTrack(stream string) *webrtc.TrackLocalStaticSample {
+	s.tracksMu.Lock()
+	defer s.tracksMu.Unlock()
+	if stream == "navi" {
+		return s.naviTrack
+	}
+	return s.videoTrack
+}
 
-	pc, err := api.NewPeerConnection(config)
-	if err != nil {
-		return nil, err
+// addAudioChannel has the audio sent to d until pc is closed or fails.
+func (s *session) addAudioChannel(pc *webrtc.PeerConnection, d *webrtc.DataChannel) {
+	s.tracksMu.Lock()
+	if s.audioChannels == nil {
+		s.audioChannels = make(map[*webrtc.DataChannel]bool)
 	}
+	s.audioChannels[d] = true
+	s.tracksMu.Unlock()
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed || state == webrtc.PeerConnectionStateClosed {
+			s.tracksMu.Lock()
+			delete(s.audioChannels, d)
+			s.tracksMu.Unlock()
+		}
+	})
+}
 
-	stats, ok := pc.GetStats().GetConnectionStats(pc)
-	if !ok {
-		stats.ID = "unknoown"
+// audioViewers returns the audio channels of the viewers.
+func (s *session) audioViewers() []*webrtc.DataChannel {
+	s.tracksMu.Lock()
+	defer s.tracksMu.Unlock()
+	channels := make([]*webrtc.DataChannel, 0, len(s.audioChannels))
+	for d := range s.audioChannels {
+		channels = append(channels, d)
 	}
+	return channels
+}
 
-	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
-		log.Printf("State of %s: %s \n", stats.ID, connectionState.String())
+// acceptDataChannels handles the channels a viewer opens for its input.
+func (s *session) acceptDataChannels(pc *webrtc.PeerConnection) {
+	pc.OnDataChannel(func(d *webrtc.DataChannel) {
+		switch d.Label() {
+		case "touch":
+			d.OnMessage(func(msg webrtc.DataChannelMessage) {
+				s.sendTouch(msg.Data)
+			})
+		case "start":
+			d.OnMessage(func(msg webrtc.DataChannelMessage) {
+				s.startCarPlay(msg.Data)
+			})
+		case "resize":
+			d.OnMessage(func(msg webrtc.DataChannelMessage) {
+				s.resizeCarPlay(msg.Data)
+			})
+		}
 	})
+}
 
-	// Create a video track
-	videoCodec := webrtc.RTPCodecCapability{
-		MimeType:  webrtc.MimeTypeH264,
-		ClockRate: 90000,
-		Channels:  0,
-		//SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032",
-		SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f",
-		RTCPFeedback: nil,
+// newViewer creates the peer connection of a viewer with its video track
+// and data channels. stream selects the video sent: the main CarPlay
+// screen, or "navi" for the instrument cluster stream.
+func (s *session) newViewer(stream string) (*webrtc.PeerConnection, error) {
+	pc, err := newPeerConnection()
+	if err != nil {
+		return nil, err
 	}
-	if videoTrack, err = webrtc.NewTrackLocalStaticSample(videoCodec, "video", "video"); err != nil {
+	track, err := s.track(stream)
+	if err != nil {
 		return nil, err
 	}
 
-	if _, err = pc.AddTransceiverFromTrack(videoTrack,
+	if _, err = pc.AddTransceiverFromTrack(track,
 		webrtc.RTPTransceiverInit{
 			Direction: webrtc.RTPTransceiverDirectionSendonly,
 		},
@@ -87,23 +144,38 @@ func setupWebRTC(offer webrtc.SessionDescription) (*webrtc.SessionDescription, e
 	}
 
 	// Create a data channels
-	audioDataChannel, err = pc.CreateDataChannel("audio", nil)
+	if stream != "navi" {
+		audioChannel, err := pc.CreateDataChannel("audio", nil)
+		if err != nil {
+			return nil, err
+		}
+		s.addAudioChannel(pc, audioChannel)
+	}
+
+	nowPlayingChannel, err := pc.CreateDataChannel("nowplaying", nil)
 	if err != nil {
 		return nil, err
 	}
+	s.events.forward(nowPlayingChannel, func() []event {
+		return []event{{Type: "nowplaying", Time: time.Now(), Data: s.nowPlaying.get()}}
+	}, "nowplaying")
 
-	pc.OnDataChannel(func(d *webrtc.DataChannel) {
-		switch d.Label() {
-		case "touch":
-			d.OnMessage(func(msg webrtc.DataChannelMessage) {
-				sendTouch(msg.Data)
-			})
-		case "start":
-			d.OnMessage(func(msg webrtc.DataChannelMessage) {
-				startCarPlay(msg.Data)
-			})
-		}
-	})
+	statusChannel, err := pc.CreateDataChannel("status", nil)
+	if err != nil {
+		return nil, err
+	}
+	s.events.forward(statusChannel, s.status.statusEvents, "dongle", "phone", "wifi", "video", "error", "incident")
+
+	s.acceptDataChannels(pc)
+	return pc, nil
+}
+
+// setupWebRTC answers a viewer's offer carrying all of its candidates.
+func (s *session) setupWebRTC(offer webrtc.SessionDescription, stream string) (*webrtc.SessionDescription, error) {
+	pc, err := s.newViewer(stream)
+	if err != nil {
+		return nil, err
+	}
 
 	// Set the remote SessionDescription
 	if err := pc.SetRemoteDescription(offer); err != nil {
@@ -124,7 +196,7 @@ func setupWebRTC(offer webrtc.SessionDescription) (*webrtc.SessionDescription, e
 	return &answer, nil
 }
 
-func webRTCOfferHandler(w http.ResponseWriter, r *http.Request) {
+func (s *session) webRTCOfferHandler(w http.ResponseWriter, r *http.Request) {
 	var offer webrtc.SessionDescription
 	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -132,7 +204,7 @@ func webRTCOfferHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	answer, err := setupWebRTC(offer)
+	answer, err := s.setupWebRTC(offer, r.URL.Query().Get("stream"))
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		fmt.Fprintf(w, "{\"error\": \"%s\"}", err.Error())
@@ -143,48 +215,196 @@ func webRTCOfferHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(&answer)
 }
 
-func sendTouch(data []byte) {
-	if usbLink != nil {
+func (s *session) sendTouch(data []byte) {
+	if pipeline := s.pipeline(); pipeline != nil {
 		var touch deviceTouch
 		if err := json.Unmarshal(data, &touch); err != nil {
 			return
 		}
-		usbLink.SendMessage(&protocol.Touch{X: uint32(touch.X * 10000 / float32(size.Width)), Y: uint32(touch.Y * 10000 / float32(size.Height)), Action: protocol.TouchAction(touch.Action)})
+		if touch.Width <= 0 || touch.Height <= 0 {
+			viewer := s.viewerSize()
+			touch.Width, touch.Height = float32(viewer.Width), float32(viewer.Height)
+		}
+		x, y, inside := s.touchLayout(touch.Width, touch.Height).Map(float64(touch.X), float64(touch.Y))
+		action := protocol.TouchAction(touch.Action)
+		if !s.touchGesture(action, inside) {
+			return
+		}
+		pipeline.Push(protocol.Touch{X: x, Y: y, Action: action})
 	}
 }
 
-func startCarPlay(data []byte) {
-	if err := json.Unmarshal(data, &size); err != nil {
+// touchGesture tells whether a touch belongs to a gesture for the phone. A
+// press on a letterbox bar is not meant for the phone, nor is the gesture
+// that follows it.
+func (s *session) touchGesture(action protocol.TouchAction, inside bool) bool {
+	s.touchMu.Lock()
+	defer s.touchMu.Unlock()
+	switch action {
+	case protocol.TouchDown:
+		s.touchActive = inside
+		return inside
+	case protocol.TouchUp:
+		active := s.touchActive
+		s.touchActive = false
+		return active
+	}
+	return s.touchActive
+}
+
+func (s *session) touchStatsHandler(w http.ResponseWriter, r *http.Request) {
+	pipeline := s.pipeline()
+	if pipeline == nil {
+		writeJSON(w, touch.Stats{})
 		return
 	}
+	writeJSON(w, pipeline.Stats())
+}
 
-	duration := time.Duration((float32(1) / float32(fps)) * float32(time.Second))
+func (s *session) sendGnss(data []byte) {
+	if link := s.link(); link != nil {
+		link.SendMessage(&protocol.GnssData{Data: data})
+	}
+}
 
-	usbLink = new(usblink.USBLink)
-	usbLink.Start(func() {
-		log.Println("device ready to init", size.Width, size.Height)
-		initCarplay(size.Width, size.Height, fps, 160)
-	}, func(data protocol.VideoData) {
-		videoTrack.WriteSample(media.Sample{Data: data.Data, Duration: duration})
-	},
-		func(data protocol.AudioData) {
-			return
-			if len(data.Data) == 0 {
-				//log.Printf("[onData] %#v", data)
-			} else {
-				var buf bytes.Buffer
-				fr := protocol.AudioDecodeTypes[data.DecodeType].Frequency
-				ch := protocol.AudioDecodeTypes[data.DecodeType].Channel
-				binary.Write(&buf, binary.LittleEndian, fr)
-				binary.Write(&buf, binary.LittleEndian, ch)
-				audioDataChannel.Send(append(buf.Bytes(), data.Data...))
+func (s *session) startCarPlay(data []byte) {
+	var newSize deviceSize
+	if err := json.Unmarshal(data, &newSize); err != nil {
+		return
+	}
+	if !s.start(newSize) {
+		// another viewer started the dongle already, the phone is asked
+		// for a keyframe as a resize to the same size sends no Open
+		s.resizeCarPlay(data)
+		s.requestKeyFrame()
+	}
+}
+
+// requestKeyFrame asks the phone for a keyframe, which viewers and sinks
+// joining a running link wait for.
+func (s *session) requestKeyFrame() {
+	if link := s.link(); link != nil {
+		link.SendMessage(&protocol.CarPlay{Type: protocol.RequestKeyFrame})
+	}
+}
+
+// link is the link to the dongle, nil until the session starts.
+func (s *session) link() dongleLink {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	return s.usbLink
+}
+
+func (s *session) pipeline() *touch.Pipeline {
+	s.linkMu.Lock()
+	defer s.linkMu.Unlock()
+	return s.touchPipeline
+}
+
+// start opens the link to the dongle for a viewer of the given size. It
+// reports false if the link is open already.
+func (s *session) start(size deviceSize) bool {
+	s.linkMu.Lock()
+	if s.usbLink != nil {
+		s.linkMu.Unlock()
+		return false
+	}
+	s.setViewerSize(size)
+	link := s.openLink()
+	s.usbLink = link
+	s.touchPipeline = touch.NewPipeline(cfg.TouchRate, func(t *protocol.Touch) error {
+		return link.SendMessageWait(t)
+	})
+	s.touchStop = make(chan struct{})
+	go s.touchPipeline.Run(s.touchStop)
+	s.linkMu.Unlock()
+
+	s.status.setDongle(dongleSearching)
+	if err := link.Start(s.onReady, s.onVideo, s.onAudio, s.onData, s.onError); err != nil {
+		s.onError(err)
+	}
+	return true
+}
+
+// stop closes the link to the dongle and ends its touch pipeline.
+func (s *session) stop() {
+	s.linkMu.Lock()
+	link, touchStop := s.usbLink, s.touchStop
+	s.usbLink, s.touchPipeline = nil, nil
+	s.linkMu.Unlock()
+	if link == nil {
+		return
+	}
+	// the link's callbacks may still ask for it while it stops
+	link.Stop()
+	close(touchStop)
+}
+
+func (s *session) onReady() {
+	viewer := s.viewerSize()
+	log.Println("device ready to init", viewer.Width, viewer.Height)
+	s.status.setDongle(dongleReady)
+	s.initCarplay(viewer.Width, viewer.Height, fps, carPlayDPI)
+}
+
+func (s *session) onVideo(data protocol.VideoData) {
+	now := time.Now()
+	s.trackFrameSize(data)
+	if track := s.sharedTrack(""); track != nil {
+		track.WriteSample(media.Sample{Data: data.Data, Duration: time.Second / time.Duration(fps)})
+	}
+	s.writeSinks(sink.Frame{Time: now, Width: int(data.Width), Height: int(data.Height), Data: data.Data})
+	s.recording.video(now, data)
+}
+
+func (s *session) onAudio(data protocol.AudioData) {
+	s.recording.audioData(time.Now(), data)
+	if !cfg.AudioChannel {
+		return
+	}
+	channels := s.audioViewers()
+	if len(channels) == 0 {
+		return
+	}
+	if len(data.Data) == 0 {
+		//log.Printf("[onData] %#v", data)
+	} else {
+		var buf bytes.Buffer
+		fr := protocol.AudioDecodeTypes[data.DecodeType].Frequency
+		ch := protocol.AudioDecodeTypes[data.DecodeType].Channel
+		binary.Write(&buf, binary.LittleEndian, fr)
+		binary.Write(&buf, binary.LittleEndian, ch)
+		msg := append(buf.Bytes(), data.Data...)
+		for _, d := range channels {
+			d.Send(msg)
+		}
+	}
+}
+
+func (s *session) onData(data interface{}) {
+	//log.Printf("[onData] %#v", data)
+	s.adaptPhoneType(data)
+	s.status.onData(data)
+	s.bluetooth.onData(data)
+	switch data := data.(type) {
+	case *protocol.NaviVideoData:
+		if track := s.sharedTrack("navi"); track != nil {
+			naviDuration := time.Second / time.Duration(fps)
+			if cfg.NaviFPS > 0 {
+				naviDuration = time.Second / time.Duration(cfg.NaviFPS)
 			}
-		},
-		func(data interface{}) {
-			//log.Printf("[onData] %#v", data)
-		}, func(err error) {
-			log.Fatalf("[ERROR] %#v", err)
-		})
+			track.WriteSample(media.Sample{Data: data.Data, Duration: naviDuration})
+		}
+	case *protocol.MediaData:
+		s.nowPlaying.update(data)
+	case *protocol.Unplugged:
+		s.nowPlaying.clear()
+	}
+}
+
+func (s *session) onError(err error) {
+	log.Printf("[ERROR] %#v", err)
+	s.status.onError(err)
 }
 
 func intToByte(data int32) []byte {
@@ -193,15 +413,63 @@ func intToByte(data int32) []byte {
 	return buf.Bytes()
 }
 
-func initCarplay(width, height, fps, dpi int32) {
-	usbLink.SendMessage(&protocol.SendFile{FileName: "/tmp/screen_dpi\x00", Content: intToByte(dpi)})
-	usbLink.SendMessage(&protocol.Open{Width: width, Height: height, VideoFrameRate: fps, Format: 5, PacketMax: 4915200, IBoxVersion: 2, PhoneWorkMode: 2})
+func boolToByte(data bool) []byte {
+	if data {
+		return intToByte(1)
+	}
+	return intToByte(0)
+}
 
-	usbLink.SendMessage(&protocol.ManufacturerInfo{A: 0, B: 0})
-	usbLink.SendMessage(&protocol.SendFile{FileName: "/tmp/night_mode\x00", Content: intToByte(1)})
-	usbLink.SendMessage(&protocol.SendFile{FileName: "/tmp/hand_drive_mode\x00", Content: intToByte(1)})
-	usbLink.SendMessage(&protocol.SendFile{FileName: "/tmp/charge_mode\x00", Content: intToByte(0)})
-	usbLink.SendMessage(&protocol.SendFile{FileName: "/tmp/box_name\x00", Content: bytes.NewBufferString("BoxName").Bytes()})
+// openMessage is the Open of the handshake for a screen of the given size.
+func openMessage(width, height, fps int32) *protocol.Open {
+	return &protocol.Open{Width: width, Height: height, VideoFrameRate: fps, Format: 5, PacketMax: 4915200, IBoxVersion: 2, PhoneWorkMode: 2}
+}
+
+func (s *session) initCarplay(width, height, fps, dpi int32) {
+	androidWorkMode := cfg.PhoneMode == phoneModeAndroidAuto
+	aaSize, aaDPI := androidAutoMode(deviceSize{Width: width, Height: height})
+	if androidWorkMode {
+		dpi = aaDPI
+	}
+
+	link := s.link()
+	link.SendMessage(&protocol.SendFile{FileName: "/tmp/screen_dpi\x00", Content: intToByte(dpi)})
+	link.SendMessage(openMessage(width, height, fps))
+
+	link.SendMessage(&protocol.ManufacturerInfo{A: 0, B: 0})
+	link.SendMessage(&protocol.SendFile{FileName: "/tmp/night_mode\x00", Content: intToByte(1)})
+	link.SendMessage(&protocol.SendFile{FileName: "/tmp/hand_drive_mode\x00", Content: intToByte(1)})
+	link.SendMessage(&protocol.SendFile{FileName: "/tmp/charge_mode\x00", Content: intToByte(0)})
+	link.SendMessage(&protocol.SendFile{FileName: "/tmp/box_name\x00", Content: bytes.NewBufferString("BoxName").Bytes()})
+	link.SendMessage(&protocol.SendFile{FileName: "/etc/android_work_mode\x00", Content: boolToByte(androidWorkMode)})
+
+	boxConfig := protocol.BoxConfig{
+		SyncTime:         time.Now().Unix(),
+		MediaDelay:       cfg.MediaDelay,
+		AndroidAutoSizeW: aaSize.Width,
+		AndroidAutoSizeH: aaSize.Height,
+		WifiName:         cfg.WifiName,
+		WifiChannel:      cfg.WifiChannel,
+	}
+	if cfg.NaviWidth > 0 && cfg.NaviHeight > 0 {
+		boxConfig.NaviScreenInfo = &protocol.NaviScreenInfo{Width: int32(cfg.NaviWidth), Height: int32(cfg.NaviHeight), FPS: int32(cfg.NaviFPS)}
+	}
+	settings, err := protocol.NewBoxSettings(boxConfig)
+	if err != nil {
+		log.Printf("[initCarplay] %s\n", err)
+		return
+	}
+	link.SendMessage(settings)
+
+	if cfg.Wifi {
+		if err := s.enableWifi(cfg.WifiBand); err != nil {
+			log.Printf("[initCarplay] %s\n", err)
+		}
+	}
+
+	if addr := s.bluetooth.get().AutoConnect; addr != "" {
+		link.SendMessage(&protocol.ConnectBluetooth{Address: protocol.NullTermString(addr)})
+	}
 }
 
 var epoch = time.Unix(0, 0).Format(time.RFC1123)
@@ -240,9 +508,13 @@ func NoCache(h http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// broadcastGnss forwards a location update to every dongle.
+func broadcastGnss(data []byte) {
+	for _, s := range sessions {
+		s.sendGnss(data)
+	}
+}
+
 func main() {
-	log.Println("http://localhost:8001")
-	http.HandleFunc("/connect", webRTCOfferHandler)
-	http.Handle("/", NoCache(http.FileServer(http.Dir("./"))))
-	log.Fatal(http.ListenAndServe(":8001", nil))
+	os.Exit(run(os.Args[1:]))
 }
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+	"time"
+	"webrtc/usblink"
+)
+
+func TestAudioChannelsPerViewer(t *testing.T) {
+	s := newSession("test", usblink.Selector{})
+	first, err := s.newViewer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	second, err := s.newViewer("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.audioViewers()); n != 2 {
+		t.Fatalf("%d audio channels for 2 viewers", n)
+	}
+	if s.sharedTrack("") == nil || s.sharedTrack("navi") != nil {
+		t.Fatal("unexpected shared tracks")
+	}
+
+	second.Close()
+	for deadline := time.Now().Add(time.Second); len(s.audioViewers()) != 1; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d audio channels after a viewer left", len(s.audioViewers()))
+		}
+	}
+}
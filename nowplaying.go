@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"webrtc/protocol"
+)
+
+type nowPlayingInfo struct {
+	Title    string    `json:"title"`
+	Artist   string    `json:"artist"`
+	Album    string    `json:"album"`
+	App      string    `json:"app"`
+	Duration int       `json:"duration"` // milliseconds
+	Position int       `json:"position"` // milliseconds, as of Updated
+	AlbumArt string    `json:"albumArt,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+type nowPlayingState struct {
+	mu         sync.Mutex
+	info       nowPlayingInfo
+	albumArt   []byte
+	artVersion int
+	artPath    string
+	events     *eventHub
+}
+
+func (s *nowPlayingState) get() nowPlayingInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.info
+}
+
+func (s *nowPlayingState) update(data *protocol.MediaData) {
+	s.mu.Lock()
+	switch {
+	case data.Info != nil:
+		m := data.Info
+		if m.SongName != "" && m.SongName != s.info.Title {
+			// new track: forget what belonged to the previous one
+			s.info = nowPlayingInfo{AlbumArt: s.info.AlbumArt}
+		}
+		if m.SongName != "" {
+			s.info.Title = m.SongName
+		}
+		if m.ArtistName != "" {
+			s.info.Artist = m.ArtistName
+		}
+		if m.AlbumName != "" {
+			s.info.Album = m.AlbumName
+		}
+		if m.AppName != "" {
+			s.info.App = m.AppName
+		}
+		if m.SongDuration != 0 {
+			s.info.Duration = m.SongDuration
+		}
+		if m.SongPlayTime != nil {
+			s.info.Position = *m.SongPlayTime
+		}
+	case data.AlbumCover != nil:
+		s.albumArt = data.AlbumCover
+		s.artVersion++
+		s.info.AlbumArt = fmt.Sprintf("%s?v=%d", s.artPath, s.artVersion)
+	default:
+		s.mu.Unlock()
+		return
+	}
+	s.info.Updated = time.Now()
+	info := s.info
+	s.mu.Unlock()
+
+	s.events.publish("nowplaying", info)
+}
+
+func (s *nowPlayingState) clear() {
+	s.mu.Lock()
+	s.info = nowPlayingInfo{Updated: time.Now()}
+	s.albumArt = nil
+	info := s.info
+	s.mu.Unlock()
+
+	s.events.publish("nowplaying", info)
+}
+
+func (s *session) nowPlayingHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.nowPlaying.get())
+}
+
+func (s *session) albumArtHandler(w http.ResponseWriter, r *http.Request) {
+	s.nowPlaying.mu.Lock()
+	art := s.nowPlaying.albumArt
+	s.nowPlaying.mu.Unlock()
+
+	if art == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(art))
+	w.Write(art)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+	"webrtc/protocol"
+)
+
+func TestNowPlayingKeepsPosition(t *testing.T) {
+	s := nowPlayingState{events: &eventHub{}}
+	playTime := 42000
+	s.update(&protocol.MediaData{Info: &protocol.MediaInfo{SongName: "Song", SongPlayTime: &playTime}})
+	s.update(&protocol.MediaData{Info: &protocol.MediaInfo{ArtistName: "Artist"}})
+	if info := s.get(); info.Position != playTime || info.Artist != "Artist" {
+		t.Fatalf("a metadata update changed the position: %+v", info)
+	}
+
+	playTime = 0
+	s.update(&protocol.MediaData{Info: &protocol.MediaInfo{SongPlayTime: &playTime}})
+	if info := s.get(); info.Position != 0 {
+		t.Fatalf("a play time of 0 was ignored: %+v", info)
+	}
+}
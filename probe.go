@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"webrtc/protocol"
+	"webrtc/usblink"
+)
+
+// probeReport is printed as JSON by the probe command.
+type probeReport struct {
+	Devices    []usblink.DeviceInfo `json:"devices"`
+	Device     string               `json:"device,omitempty"`
+	Layout     *usblink.Layout      `json:"layout,omitempty"`
+	Handshake  *probeHandshake      `json:"handshake,omitempty"`
+	RoundTrip  *probeRoundTrip      `json:"roundTrip,omitempty"`
+	Throughput *probeThroughput     `json:"throughput,omitempty"`
+	Errors     []string             `json:"errors,omitempty"`
+
+	mu sync.Mutex
+}
+
+// probeHandshake holds what the dongle announced after Open, with the time
+// each answer took in milliseconds.
+type probeHandshake struct {
+	SoftwareVersion  string             `json:"softwareVersion,omitempty"`
+	BluetoothAddress string             `json:"bluetoothAddress,omitempty"`
+	WifiDeviceName   string             `json:"wifiDeviceName,omitempty"`
+	Timings          map[string]float64 `json:"timingsMs"`
+	Missing          []string           `json:"missing,omitempty"`
+}
+
+// probeRoundTrip times BoxSettings requests until the dongle's BoxSettings
+// answer arrives.
+type probeRoundTrip struct {
+	Samples int     `json:"samples"`
+	Lost    int     `json:"lost"`
+	MinMs   float64 `json:"minMs,omitempty"`
+	AvgMs   float64 `json:"avgMs,omitempty"`
+	MaxMs   float64 `json:"maxMs,omitempty"`
+}
+
+// probeThroughput is the rate of a bulk write to the dongle. Nothing makes
+// the dongle send in bulk without a phone, so the IN direction is not
+// measured.
+type probeThroughput struct {
+	OutBytes    int64   `json:"outBytes"`
+	OutSeconds  float64 `json:"outSeconds"`
+	OutBytesSec float64 `json:"outBytesPerSecond"`
+}
+
+type probeOptions struct {
+	device    usblink.Selector
+	list      bool
+	timeout   time.Duration
+	samples   int
+	bulkBytes int
+}
+
+// fail records an error, the link reports its errors from its own goroutines.
+func (r *probeReport) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Errors = append(r.Errors, err.Error())
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// runProbe is the probe command: it lists the dongles, opens the first
+// -dongle, runs the init handshake and measures the link.
+func runProbe(args []string) int {
+	fs := newFlagSet("probe")
+	list := fs.Bool("list", false, "only list the dongles with their descriptors")
+	timeout := fs.Duration("timeout", 10*time.Second, "how long to wait for the dongle and for the handshake")
+	samples := fs.Int("rtt-samples", 5, "round trips to measure")
+	bulkBytes := fs.Int("bulk-bytes", 1<<20, "bytes to write for the throughput measurement (0 skips it)")
+	cfg = loadConfig(fs, args)
+
+	opts := probeOptions{device: firstDongle().Device, list: *list, timeout: *timeout, samples: *samples, bulkBytes: *bulkBytes}
+
+	report := &probeReport{}
+	probe(report, opts)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+func probe(report *probeReport, opts probeOptions) {
+	devices, err := usblink.Probe()
+	report.Devices = devices
+	if err != nil {
+		report.fail(err)
+	}
+	if len(devices) == 0 {
+		report.fail(errors.New("no dongle found"))
+		return
+	}
+	if opts.list {
+		return
+	}
+
+	ready := make(chan struct{}, 1)
+	packets := make(chan interface{}, 256)
+	link := &usblink.USBLink{Device: opts.device}
+	link.Start(func() {
+		select {
+		case ready <- struct{}{}:
+		default:
+		}
+	}, func(protocol.VideoData) {}, func(protocol.AudioData) {}, func(data interface{}) {
+		select {
+		case packets <- data:
+		default:
+		}
+	}, func(err error) {
+		report.fail(err)
+	})
+	defer link.Stop()
+
+	select {
+	case <-ready:
+	case <-time.After(opts.timeout):
+		report.fail(fmt.Errorf("dongle %s did not open within %s", opts.device, opts.timeout))
+		return
+	}
+	health := link.Health()
+	report.Device, report.Layout = health.Device, health.Layout
+
+	handshake, err := probeInit(link, packets, opts.timeout)
+	if err != nil {
+		report.fail(err)
+		return
+	}
+	report.Handshake = handshake
+	if len(report.Handshake.Missing) > 0 {
+		report.fail(fmt.Errorf("dongle did not send %v", report.Handshake.Missing))
+	}
+	if opts.samples > 0 {
+		report.RoundTrip = probeRoundTrips(link, packets, opts.samples)
+	}
+	if opts.bulkBytes > 0 {
+		throughput, err := probeBulk(link, opts.bulkBytes)
+		if err != nil {
+			report.fail(err)
+		}
+		report.Throughput = throughput
+	}
+}
+
+// probeInit sends the start of the usual init sequence and waits for the
+// dongle to introduce itself. The dongle is opened with the -width and
+// -height of a headless start.
+func probeInit(link *usblink.USBLink, packets chan interface{}, timeout time.Duration) (*probeHandshake, error) {
+	handshake := &probeHandshake{Timings: make(map[string]float64)}
+	start := time.Now()
+	if err := link.SendMessage(&protocol.SendFile{FileName: "/tmp/screen_dpi\x00", Content: intToByte(carPlayDPI)}); err != nil {
+		return nil, err
+	}
+	if err := link.SendMessageWait(openMessage(int32(cfg.Width), int32(cfg.Height), fps)); err != nil {
+		return nil, err
+	}
+	handshake.Timings["open"] = milliseconds(time.Since(start))
+
+	deadline := time.After(timeout)
+	for handshake.SoftwareVersion == "" || handshake.BluetoothAddress == "" || handshake.WifiDeviceName == "" {
+		select {
+		case data := <-packets:
+			switch data := data.(type) {
+			case *protocol.SoftwareVersion:
+				handshake.SoftwareVersion = trimNull(data.Version)
+				handshake.Timings["softwareVersion"] = milliseconds(time.Since(start))
+			case *protocol.BluetoothAddress:
+				handshake.BluetoothAddress = trimNull(data.Address)
+				handshake.Timings["bluetoothAddress"] = milliseconds(time.Since(start))
+			case *protocol.WifiDeviceName:
+				handshake.WifiDeviceName = trimNull(data.Data)
+				handshake.Timings["wifiDeviceName"] = milliseconds(time.Since(start))
+			}
+		case <-deadline:
+			if handshake.SoftwareVersion == "" {
+				handshake.Missing = append(handshake.Missing, "SoftwareVersion")
+			}
+			if handshake.BluetoothAddress == "" {
+				handshake.Missing = append(handshake.Missing, "BluetoothAddress")
+			}
+			if handshake.WifiDeviceName == "" {
+				handshake.Missing = append(handshake.Missing, "WifiDeviceName")
+			}
+			return handshake, nil
+		}
+	}
+	return handshake, nil
+}
+
+// probeRoundTripTimeout is how long a BoxSettings answer may take before the
+// sample counts as lost.
+const probeRoundTripTimeout = 2 * time.Second
+
+func probeRoundTrips(link *usblink.USBLink, packets chan interface{}, samples int) *probeRoundTrip {
+	rtt := &probeRoundTrip{Samples: samples}
+	var total time.Duration
+	for i := 0; i < samples; i++ {
+		settings, err := protocol.NewBoxSettings(protocol.BoxConfig{SyncTime: time.Now().Unix()})
+		if err != nil {
+			rtt.Lost++
+			continue
+		}
+		// an earlier answer, the init's or a lost sample's, is not this one
+		drainPackets(packets)
+		start := time.Now()
+		if err := link.SendMessageWait(settings); err != nil {
+			rtt.Lost++
+			continue
+		}
+		elapsed, ok := waitBoxSettings(packets, start)
+		if !ok {
+			rtt.Lost++
+			continue
+		}
+		total += elapsed
+		ms := milliseconds(elapsed)
+		if rtt.MinMs == 0 || ms < rtt.MinMs {
+			rtt.MinMs = ms
+		}
+		if ms > rtt.MaxMs {
+			rtt.MaxMs = ms
+		}
+	}
+	if received := samples - rtt.Lost; received > 0 {
+		rtt.AvgMs = milliseconds(total / time.Duration(received))
+	}
+	return rtt
+}
+
+func drainPackets(packets chan interface{}) {
+	for {
+		select {
+		case <-packets:
+		default:
+			return
+		}
+	}
+}
+
+func waitBoxSettings(packets chan interface{}, start time.Time) (time.Duration, bool) {
+	timeout := time.After(probeRoundTripTimeout)
+	for {
+		select {
+		case data := <-packets:
+			if _, ok := data.(*protocol.BoxSettings); ok {
+				return time.Since(start), true
+			}
+		case <-timeout:
+			return 0, false
+		}
+	}
+}
+
+// probeBulkChunk is the size of the files written to measure throughput.
+const probeBulkChunk = 64 << 10
+
+// probeBulk writes size bytes into a scratch file on the dongle and reports
+// the rate.
+func probeBulk(link *usblink.USBLink, size int) (*probeThroughput, error) {
+	throughput := &probeThroughput{}
+	chunk := make([]byte, probeBulkChunk)
+	start := time.Now()
+	for written := 0; written < size; written += len(chunk) {
+		if size-written < len(chunk) {
+			chunk = chunk[:size-written]
+		}
+		msg := &protocol.SendFile{FileName: "/tmp/gocarplay_probe\x00", Content: chunk}
+		if err := link.SendMessageWait(msg); err != nil {
+			return throughput, err
+		}
+		throughput.OutBytes += int64(len(chunk))
+	}
+	throughput.OutSeconds = time.Since(start).Seconds()
+	if throughput.OutSeconds > 0 {
+		throughput.OutBytesSec = float64(throughput.OutBytes) / throughput.OutSeconds
+	}
+	return throughput, nil
+}
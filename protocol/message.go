@@ -3,6 +3,7 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"io"
 	"math"
@@ -29,7 +30,14 @@ const (
 	TouchPacketType               uint32 = 0x05
 	BluetoothDeviceNamePacketType uint32 = 0x0d
 	WifiDeviceNamePacketType      uint32 = 0x0e
+	DisconnectPhonePacketType     uint32 = 0x0f
+	ForgetBluetoothPacketType     uint32 = 0x10
+	ConnectBluetoothPacketType    uint32 = 0x11
 	BluetoothPairedListPacketType uint32 = 0x12
+	BoxSettingsPacketType         uint32 = 0x19
+	GnssDataPacketType            uint32 = 0x29
+	MediaDataPacketType           uint32 = 0x2a
+	NaviVideoDataPacketType       uint32 = 0x2c
 )
 
 var messageTypes = map[reflect.Type]uint32{
@@ -48,7 +56,14 @@ var messageTypes = map[reflect.Type]uint32{
 	reflect.TypeOf(&Touch{}):               0x05,
 	reflect.TypeOf(&BluetoothDeviceName{}): 0x0d,
 	reflect.TypeOf(&WifiDeviceName{}):      0x0e,
+	reflect.TypeOf(&DisconnectPhone{}):     0x0f,
+	reflect.TypeOf(&ForgetBluetooth{}):     0x10,
+	reflect.TypeOf(&ConnectBluetooth{}):    0x11,
 	reflect.TypeOf(&BluetoothPairedList{}): 0x12,
+	reflect.TypeOf(&BoxSettings{}):         0x19,
+	reflect.TypeOf(&GnssData{}):            0x29,
+	reflect.TypeOf(&MediaData{}):           0x2a,
+	reflect.TypeOf(&NaviVideoData{}):       0x2c,
 }
 
 // Header is header structure of data protocol
@@ -60,6 +75,11 @@ type Header struct {
 }
 
 func packPayload(buffer io.Writer, payload interface{}) error {
+	switch payload := payload.(type) {
+	case *BoxSettings:
+		_, err := buffer.Write(payload.Data)
+		return err
+	}
 	if reflect.ValueOf(payload).Elem().NumField() > 0 {
 		return struc.Pack(buffer, payload)
 	}
@@ -124,8 +144,22 @@ func GetPayloadByHeader(hdr Header) interface{} {
 		return new(BluetoothDeviceName)
 	case WifiDeviceNamePacketType:
 		return new(WifiDeviceName)
+	case DisconnectPhonePacketType:
+		return new(DisconnectPhone)
+	case ForgetBluetoothPacketType:
+		return new(ForgetBluetooth)
+	case ConnectBluetoothPacketType:
+		return new(ConnectBluetooth)
 	case BluetoothPairedListPacketType:
 		return new(BluetoothPairedList)
+	case BoxSettingsPacketType:
+		return new(BoxSettings)
+	case GnssDataPacketType:
+		return new(GnssData)
+	case MediaDataPacketType:
+		return new(MediaData)
+	case NaviVideoDataPacketType:
+		return new(NaviVideoData)
 	}
 	return &Unknown{Type: hdr.Type}
 }
@@ -203,6 +237,38 @@ func UnmarshalHeader(data []byte) (Header, error) {
 	return hdr, nil
 }
 
+// Decode decodes a whole message, header included. Video and audio come back
+// as the VideoData and AudioData values UnmarhalVideoData and
+// UnmarshalAudioData return, navigation video as *NaviVideoData and anything
+// else as the payload GetPayloadByHeader picks.
+func Decode(data []byte) (Header, interface{}, error) {
+	if len(data) < 16 {
+		return Header{}, nil, errors.New("wrong message size (<16)")
+	}
+	hdr, err := UnmarshalHeader(data[:16])
+	if err != nil {
+		return Header{}, nil, err
+	}
+	data = data[16:]
+	if int(hdr.Length) != len(data) {
+		return hdr, nil, errors.New("wrong message size (!= header length)")
+	}
+	switch hdr.Type {
+	case VideoDataPacketType:
+		video, err := UnmarhalVideoData(data)
+		return hdr, video, err
+	case AudioDataPacketType:
+		audio, err := UnmarshalAudioData(data)
+		return hdr, audio, err
+	case NaviVideoDataPacketType:
+		video, err := UnmarhalVideoData(data)
+		navi := NaviVideoData(video)
+		return hdr, &navi, err
+	}
+	payload := GetPayloadByHeader(hdr)
+	return hdr, payload, Unmarshal(data, payload)
+}
+
 func Unmarshal(data []byte, payload interface{}) error {
 	if len(data) > 0 {
 		err := struc.Unpack(bytes.NewBuffer(data), payload)
@@ -228,12 +294,31 @@ func Unmarshal(data []byte, payload interface{}) error {
 		default:
 			payload.Data = data[12:]
 		}
+	case *Plugged:
+		if len(data) >= 8 {
+			payload.Wifi = binary.LittleEndian.Uint32(data[4:]) != 0
+		}
 	case *BluetoothDeviceName:
 		payload.Data = NullTermString(data)
 	case *WifiDeviceName:
 		payload.Data = NullTermString(data)
 	case *BluetoothPairedList:
 		payload.Data = NullTermString(data)
+		payload.Devices = ParsePairedList(string(payload.Data))
+	case *BoxSettings:
+		payload.Data = bytes.TrimRight(data, "\x00")
+		return payload.decode()
+	case *MediaData:
+		if len(data) < 4 {
+			return errors.New("wrong mediadata size (<4)")
+		}
+		switch payload.Type {
+		case MediaTypeData:
+			payload.Info = new(MediaInfo)
+			return json.Unmarshal(bytes.TrimRight(data[4:], "\x00"), payload.Info)
+		case MediaTypeAlbumCover:
+			payload.AlbumCover = data[4:]
+		}
 	case *Unknown:
 		payload.Data = data
 	}
@@ -46,3 +46,117 @@ func BenchmarkUnmarshalHeaderNew(b *testing.B) {
 		}
 	}
 }
+
+func TestUnmarshalMediaData(t *testing.T) {
+	data := append([]byte{1, 0, 0, 0}, `{"MediaSongName":"Song","MediaArtistName":"Artist","MediaSongPlayTime":1500}`+"\x00"...)
+	var media MediaData
+	if err := Unmarshal(data, &media); err != nil {
+		t.Fatal(err)
+	}
+	if media.Type != MediaTypeData || media.Info == nil {
+		t.Fatalf("unexpected media data %#v", media)
+	}
+	if media.Info.SongName != "Song" || media.Info.ArtistName != "Artist" || media.Info.SongPlayTime == nil || *media.Info.SongPlayTime != 1500 {
+		t.Fatalf("unexpected media info %#v", *media.Info)
+	}
+
+	cover := []byte{0xff, 0xd8, 0xff, 0xe0}
+	media = MediaData{}
+	if err := Unmarshal(append([]byte{3, 0, 0, 0}, cover...), &media); err != nil {
+		t.Fatal(err)
+	}
+	if media.Type != MediaTypeAlbumCover || string(media.AlbumCover) != string(cover) {
+		t.Fatalf("unexpected album cover %#v", media)
+	}
+}
+
+func TestBoxSettings(t *testing.T) {
+	settings, err := NewBoxSettings(BoxConfig{SyncTime: 1700000000, MediaDelay: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := Marshal(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := UnmarshalHeader(data[:16])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Type != BoxSettingsPacketType || string(data[16:]) != `{"syncTime":1700000000,"mediaDelay":300}` {
+		t.Fatalf("unexpected packet %q", data)
+	}
+
+	var box BoxSettings
+	info := `{"uuid":"651ede98","boxType":"YA","WiFiChannel":36,"DevList":[{"id":"64:31:35:8C:29:69","type":"CarPlay","name":"iPhone","index":"1"}]}` + "\x00"
+	if err = Unmarshal([]byte(info), &box); err != nil {
+		t.Fatal(err)
+	}
+	if box.Box == nil || box.Phone != nil || box.Box.WifiChannel != 36 || len(box.Box.DevList) != 1 {
+		t.Fatalf("unexpected box info %#v", box)
+	}
+
+	var phone BoxSettings
+	if err = Unmarshal([]byte(`{"MDLinkType":"CarPlay","MDModel":"iPhone14,5","MDOSVersion":"17.2"}`), &phone); err != nil {
+		t.Fatal(err)
+	}
+	if phone.Phone == nil || phone.Phone.Model != "iPhone14,5" {
+		t.Fatalf("unexpected phone info %#v", phone)
+	}
+}
+
+func TestUnmarshalBluetoothPairedList(t *testing.T) {
+	data := []byte("64:31:35:8C:29:69iPhone\n1C:91:80:0A:BB:02Pixel 7\n\x00")
+	var list BluetoothPairedList
+	if err := Unmarshal(data, &list); err != nil {
+		t.Fatal(err)
+	}
+	want := []PairedDevice{
+		{Address: "64:31:35:8C:29:69", Name: "iPhone"},
+		{Address: "1C:91:80:0A:BB:02", Name: "Pixel 7"},
+	}
+	if len(list.Devices) != len(want) {
+		t.Fatalf("got %d devices, want %d", len(list.Devices), len(want))
+	}
+	for i := range want {
+		if list.Devices[i] != want[i] {
+			t.Fatalf("device %d = %#v, want %#v", i, list.Devices[i], want[i])
+		}
+	}
+}
+
+func TestUnmarshalPlugged(t *testing.T) {
+	var wired, wireless Plugged
+	if err := Unmarshal([]byte{3, 0, 0, 0}, &wired); err != nil {
+		t.Fatal(err)
+	}
+	if err := Unmarshal([]byte{3, 0, 0, 0, 1, 0, 0, 0}, &wireless); err != nil {
+		t.Fatal(err)
+	}
+	if wired.PhoneType != PhoneCarPlay || wired.Wifi {
+		t.Fatalf("unexpected wired plug %#v", wired)
+	}
+	if wireless.PhoneType != PhoneCarPlay || !wireless.Wifi {
+		t.Fatalf("unexpected wireless plug %#v", wireless)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	data, err := Marshal(&CarPlay{Type: BtnHome})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, msg, err := Decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hdr.Type != CarPlayPacketType {
+		t.Fatalf("header type = %#x, want %#x", hdr.Type, CarPlayPacketType)
+	}
+	if button, ok := msg.(*CarPlay); !ok || button.Type != BtnHome {
+		t.Fatalf("unexpected message %#v", msg)
+	}
+	if _, _, err := Decode(data[:len(data)-1]); err == nil {
+		t.Fatal("Decode accepted a short message")
+	}
+}
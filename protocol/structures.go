@@ -1,6 +1,10 @@
 package protocol
 
-import "fmt"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
 
 type SendFile struct {
 	FileNameSize int32 `struc:"int32,little,sizeof=FileName"`
@@ -43,10 +47,11 @@ type BluetoothPIN struct {
 	Address NullTermString `struc:"[4]byte"`
 }
 
+// Plugged is 4 bytes long for wired phones; firmware with wireless support
+// appends a second int32 that is non-zero for wireless connections.
 type Plugged struct {
-	PhoneType int  `struc:"int32,little"`
-	Wifi      bool `struc:"skip"`
-	// FIXME: Send WifiParam only when no wifi is ok
+	PhoneType PhoneType `struc:"int32,little"`
+	Wifi      bool      `struc:"skip"`
 }
 
 type Unplugged struct {
@@ -61,6 +66,10 @@ type VideoData struct {
 	Data     []byte `struc:"[]byte"`
 }
 
+// NaviVideoData is a frame of the secondary navigation stream meant for an
+// instrument cluster. It has the same layout as VideoData.
+type NaviVideoData VideoData
+
 type AudioData struct {
 	DecodeType     DecodeType   `struc:"int32,little"`
 	Volume         float32      `struc:"float32,little"`
@@ -90,7 +99,159 @@ type WifiDeviceName struct {
 }
 
 type BluetoothPairedList struct {
-	Data NullTermString `struc:"skip"`
+	Data    NullTermString `struc:"skip"`
+	Devices []PairedDevice `struc:"skip"`
+}
+
+type PairedDevice struct {
+	Address string `json:"address"`
+	Name    string `json:"name"`
+}
+
+// ParsePairedList splits the dongle's paired list, one phone per line with
+// the name directly following its 17 character address.
+func ParsePairedList(list string) []PairedDevice {
+	var devices []PairedDevice
+	for _, line := range strings.FieldsFunc(list, func(r rune) bool { return r == '\n' || r == '\r' || r == 0 }) {
+		if len(line) < 17 || strings.Count(line[:17], ":") != 5 {
+			continue
+		}
+		devices = append(devices, PairedDevice{Address: line[:17], Name: strings.TrimSpace(line[17:])})
+	}
+	return devices
+}
+
+// DisconnectPhone ends the session with the connected phone.
+type DisconnectPhone struct {
+}
+
+// ForgetBluetooth removes a phone from the dongle's paired list.
+type ForgetBluetooth struct {
+	Address NullTermString `struc:"[17]byte"`
+}
+
+// ConnectBluetooth makes the dongle connect to a paired phone, and prefer it
+// when several paired phones are in range.
+type ConnectBluetooth struct {
+	Address NullTermString `struc:"[17]byte"`
+}
+
+// GnssData carries raw NMEA 0183 sentences (each terminated by CRLF) from
+// the car's receiver to the phone.
+type GnssData struct {
+	Length int32  `struc:"int32,little,sizeof=Data"`
+	Data   []byte `struc:"[]byte"`
+}
+
+// BoxSettings is a JSON document exchanged in both directions: the host sends
+// its preferences (BoxConfig), newer firmware reports the dongle itself
+// (BoxInfo) and the connected phone (PhoneInfo).
+type BoxSettings struct {
+	Data  []byte     `struc:"skip"`
+	Box   *BoxInfo   `struc:"skip"`
+	Phone *PhoneInfo `struc:"skip"`
+}
+
+// BoxConfig holds the settings a host may send. Zero values are omitted and
+// leave the dongle's current setting untouched.
+type BoxConfig struct {
+	SyncTime         int64  `json:"syncTime,omitempty"`   // unix seconds
+	MediaDelay       int    `json:"mediaDelay,omitempty"` // milliseconds
+	AndroidAutoSizeW int32  `json:"androidAutoSizeW,omitempty"`
+	AndroidAutoSizeH int32  `json:"androidAutoSizeH,omitempty"`
+	WifiChannel      int    `json:"WiFiChannel,omitempty"`
+	WifiName         string `json:"wifiName,omitempty"`
+	BtName           string `json:"btName,omitempty"`
+	BoxName          string `json:"boxName,omitempty"`
+	OemName          string `json:"OemName,omitempty"`
+	// NaviScreenInfo requests the navigation video stream, if the phone and
+	// firmware support it.
+	NaviScreenInfo *NaviScreenInfo `json:"naviScreenInfo,omitempty"`
+}
+
+type NaviScreenInfo struct {
+	Width  int32 `json:"width"`
+	Height int32 `json:"height"`
+	FPS    int32 `json:"fps"`
+}
+
+type BoxInfo struct {
+	UUID            string      `json:"uuid,omitempty"`
+	MFD             string      `json:"MFD,omitempty"`
+	BoxType         string      `json:"boxType,omitempty"`
+	ProductType     string      `json:"productType,omitempty"`
+	OemName         string      `json:"OemName,omitempty"`
+	HwVersion       string      `json:"hwVersion,omitempty"`
+	SupportLinkType string      `json:"supportLinkType,omitempty"`
+	SupportFeatures string      `json:"supportFeatures,omitempty"`
+	WifiChannel     int         `json:"WiFiChannel,omitempty"`
+	ChannelList     string      `json:"ChannelList,omitempty"`
+	DevList         []BoxDevice `json:"DevList,omitempty"`
+}
+
+// BoxDevice is a phone the dongle has paired with.
+type BoxDevice struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Index  string `json:"index"`
+	Time   string `json:"time"`
+	Rfcomm string `json:"rfcomm"`
+}
+
+type PhoneInfo struct {
+	LinkType    string `json:"MDLinkType,omitempty"`
+	Model       string `json:"MDModel,omitempty"`
+	OSVersion   string `json:"MDOSVersion,omitempty"`
+	LinkVersion string `json:"MDLinkVersion,omitempty"`
+	BtMacAddr   string `json:"btMacAddr,omitempty"`
+	BtName      string `json:"btName,omitempty"`
+	CpuTemp     int    `json:"cpuTemp,omitempty"`
+}
+
+func NewBoxSettings(config BoxConfig) (*BoxSettings, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	return &BoxSettings{Data: data}, nil
+}
+
+// decode fills Box or Phone from Data, depending on which document it is.
+func (b *BoxSettings) decode() error {
+	var keys map[string]json.RawMessage
+	if err := json.Unmarshal(b.Data, &keys); err != nil {
+		return err
+	}
+	if _, ok := keys["MDLinkType"]; ok {
+		b.Phone = new(PhoneInfo)
+		return json.Unmarshal(b.Data, b.Phone)
+	}
+	if _, ok := keys["uuid"]; ok {
+		b.Box = new(BoxInfo)
+		return json.Unmarshal(b.Data, b.Box)
+	}
+	return nil
+}
+
+// MediaData is sent by the dongle while media plays on the phone. Depending
+// on Type it carries either track metadata or the album cover image.
+type MediaData struct {
+	Type       MediaType  `struc:"uint32,little"`
+	Info       *MediaInfo `struc:"skip"`
+	AlbumCover []byte     `struc:"skip"`
+}
+
+// MediaInfo is the JSON document of a MediaTypeData message. The dongle only
+// sends the keys that changed, so absent values are left zero; the play
+// time, which may be zero, is nil when absent.
+type MediaInfo struct {
+	SongName     string `json:"MediaSongName,omitempty"`
+	ArtistName   string `json:"MediaArtistName,omitempty"`
+	AlbumName    string `json:"MediaAlbumName,omitempty"`
+	AppName      string `json:"MediaAPPName,omitempty"`
+	SongDuration int    `json:"MediaSongDuration,omitempty"`
+	SongPlayTime *int   `json:"MediaSongPlayTime,omitempty"`
 }
 
 type Unknown struct {
@@ -13,6 +13,9 @@ const (
 	Invalid           = CarPlayType(0)
 	BtnSiri           = CarPlayType(5)
 	CarMicrophone     = CarPlayType(7)
+	RequestKeyFrame   = CarPlayType(12)
+	Wifi24G           = CarPlayType(24)
+	Wifi5G            = CarPlayType(25)
 	BtnLeft           = CarPlayType(100)
 	BtnRight          = CarPlayType(101)
 	BtnSelectDown     = CarPlayType(104)
@@ -25,9 +28,30 @@ const (
 	BtnNextTrack      = CarPlayType(204)
 	BtnPrevTrack      = CarPlayType(205)
 	SupportWifi       = CarPlayType(1000)
+	AutoConnectEnable = CarPlayType(1001)
+	WifiConnect       = CarPlayType(1002)
+	ScanningDevice    = CarPlayType(1003)
+	DeviceFound       = CarPlayType(1004)
+	DeviceNotFound    = CarPlayType(1005)
+	ConnectFailed     = CarPlayType(1006)
+	BtConnected       = CarPlayType(1007)
+	BtDisconnected    = CarPlayType(1008)
+	WifiConnected     = CarPlayType(1009)
+	WifiDisconnected  = CarPlayType(1010)
+	BtPairStart       = CarPlayType(1011)
 	SupportWifiNeedKo = CarPlayType(1012)
 )
 
+// IsButton reports whether c is the press of a key.
+func (c CarPlayType) IsButton() bool {
+	switch c {
+	case BtnSiri, BtnLeft, BtnRight, BtnSelectDown, BtnSelectUp, BtnBack, BtnDown,
+		BtnHome, BtnPlay, BtnPause, BtnNextTrack, BtnPrevTrack:
+		return true
+	}
+	return false
+}
+
 func (c CarPlayType) GoString() string {
 	switch c {
 	case 0:
@@ -36,6 +60,12 @@ func (c CarPlayType) GoString() string {
 		return "BtnSiri"
 	case 7:
 		return "CarMicrophone"
+	case 12:
+		return "RequestKeyFrame"
+	case 24:
+		return "Wifi24G"
+	case 25:
+		return "Wifi5G"
 	case 100:
 		return "BtnLeft"
 	case 101:
@@ -60,6 +90,28 @@ func (c CarPlayType) GoString() string {
 		return "BtnPrevTrack"
 	case 1000:
 		return "SupportWifi"
+	case 1001:
+		return "AutoConnectEnable"
+	case 1002:
+		return "WifiConnect"
+	case 1003:
+		return "ScanningDevice"
+	case 1004:
+		return "DeviceFound"
+	case 1005:
+		return "DeviceNotFound"
+	case 1006:
+		return "ConnectFailed"
+	case 1007:
+		return "BtConnected"
+	case 1008:
+		return "BtDisconnected"
+	case 1009:
+		return "WifiConnected"
+	case 1010:
+		return "WifiDisconnected"
+	case 1011:
+		return "BtPairStart"
 	case 1012:
 		return "SupportWifiNeedKo"
 	}
@@ -135,6 +187,39 @@ const (
 	TouchUp   = TouchAction(16)
 )
 
+type MediaType uint32
+
+const (
+	MediaTypeData       = MediaType(1)
+	MediaTypeAlbumCover = MediaType(3)
+)
+
+type PhoneType uint32
+
+const (
+	PhoneAndroidMirror = PhoneType(1)
+	PhoneCarPlay       = PhoneType(3)
+	PhoneIPhoneMirror  = PhoneType(4)
+	PhoneAndroidAuto   = PhoneType(5)
+	PhoneHiCar         = PhoneType(6)
+)
+
+func (p PhoneType) GoString() string {
+	switch p {
+	case 1:
+		return "AndroidMirror"
+	case 3:
+		return "CarPlay"
+	case 4:
+		return "iPhoneMirror"
+	case 5:
+		return "AndroidAuto"
+	case 6:
+		return "HiCar"
+	}
+	return fmt.Sprintf("Unknown(%d)", p)
+}
+
 type NullTermString string
 
 func (s NullTermString) GoString() string {
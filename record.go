@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"webrtc/capture"
+)
+
+// runRecord is the record command: it runs the init handshake with the first
+// -dongle like a viewer would and captures the USB traffic until the
+// duration is over or the command is interrupted.
+func runRecord(args []string) int {
+	fs := newFlagSet("record")
+	output := fs.String("o", "", "capture file to write")
+	duration := fs.Duration("duration", 0, "stop recording after this long (0 records until interrupted)")
+	cfg = loadConfig(fs, args)
+	if *output == "" {
+		fmt.Fprintln(os.Stderr, "record: -o is required")
+		fs.Usage()
+		return 2
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer file.Close()
+	recorder, err := capture.NewWriter(file)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	dongle := firstDongle()
+	s := newSession(dongle.Name, dongle.Device)
+	s.recorder = recorder
+	sessions = []*session{s}
+	s.startHeadless()
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+	select {
+	case <-interrupt:
+	case <-timeout:
+	}
+	s.stop()
+
+	if err := recorder.Flush(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err := file.Close(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	log.Printf("recorded %s\n", *output)
+	return 0
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"webrtc/fmp4"
+	"webrtc/protocol"
+	"webrtc/sink"
+)
+
+// audioStream tells the dongle's audio streams apart, music and navigation
+// prompts come in different formats.
+type audioStream struct {
+	decodeType protocol.DecodeType
+	audioType  int32
+}
+
+// mp4Recording writes the video of a session, with its audio if asked for,
+// into MP4 files. A new file begins at the first keyframe after the rotation
+// interval, when the video format changes, and when an audio stream shows up
+// that the current file has no track for. As a file starts at a keyframe,
+// wantKey asks the phone for one whenever a file is due.
+type mp4Recording struct {
+	mu sync.Mutex
+
+	name    string
+	wantKey func()
+	dir     string
+	rotate  time.Duration
+	audio   bool
+
+	active     bool
+	since      time.Time
+	file       *recordingFile
+	w          *fmp4.Writer
+	opened     time.Time
+	streams    []audioStream
+	tracks     map[audioStream]int
+	rotateSoon bool
+	files      []string
+	err        error
+}
+
+// recordingStatus is the answer of /api/recording.
+type recordingStatus struct {
+	Active bool       `json:"active"`
+	Audio  bool       `json:"audio"`
+	Dir    string     `json:"dir"`
+	Rotate string     `json:"rotate"`
+	Since  *time.Time `json:"since,omitempty"`
+	File   string     `json:"file,omitempty"`
+	Files  []string   `json:"files"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// recordingFile creates its file on the first write, so a recording still
+// waiting for a keyframe leaves no empty file behind.
+type recordingFile struct {
+	path string
+	file *os.File
+}
+
+func (f *recordingFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return 0, err
+		}
+		file, err := os.Create(f.path)
+		if err != nil {
+			return 0, err
+		}
+		f.file = file
+	}
+	return f.file.Write(p)
+}
+
+func (f *recordingFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	return f.file.Close()
+}
+
+func (r *mp4Recording) start(dir string, rotate time.Duration, audio bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.active {
+		return errors.New("already recording")
+	}
+	if rotate <= 0 {
+		return errors.New("the rotation interval must be positive")
+	}
+	r.dir, r.rotate, r.audio = dir, rotate, audio
+	r.active, r.since, r.err, r.files = true, time.Now(), nil, nil
+	r.next(r.since)
+	log.Printf("recording %s to %s\n", r.name, dir)
+	return nil
+}
+
+func (r *mp4Recording) stop() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.active {
+		return errors.New("not recording")
+	}
+	r.finish()
+	r.active = false
+	return nil
+}
+
+// next closes the current file and begins the next one, named after the
+// session and the time.
+func (r *mp4Recording) next(now time.Time) {
+	r.finish()
+	name := fmt.Sprintf("%s-%s.mp4", r.name, now.Format("20060102-150405.000"))
+	r.file = &recordingFile{path: filepath.Join(r.dir, name)}
+	r.tracks = make(map[audioStream]int)
+	var audio []fmp4.AudioConfig
+	if r.audio {
+		for i, stream := range r.streams {
+			format := protocol.AudioDecodeTypes[stream.decodeType]
+			audio = append(audio, fmp4.AudioConfig{SampleRate: int(format.Frequency), Channels: int(format.Channel)})
+			r.tracks[stream] = i
+		}
+	}
+	r.w = fmp4.NewWriter(r.file, audio)
+	r.opened = now
+	r.rotateSoon = false
+	r.requestKey()
+}
+
+func (r *mp4Recording) requestKey() {
+	if r.wantKey != nil {
+		r.wantKey()
+	}
+}
+
+func (r *mp4Recording) finish() {
+	if r.w == nil {
+		return
+	}
+	if err := r.w.Close(); err != nil {
+		r.fail(err)
+	}
+	if err := r.file.Close(); err != nil {
+		r.fail(err)
+	}
+	if r.file.file != nil {
+		r.files = append(r.files, r.file.path)
+	}
+	r.w, r.file = nil, nil
+}
+
+// fail stops writing after an error, the error shows in the status.
+func (r *mp4Recording) fail(err error) {
+	if r.err == nil {
+		log.Printf("[recording] %s\n", err)
+		r.err = err
+	}
+}
+
+func (r *mp4Recording) video(now time.Time, data protocol.VideoData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.active || r.err != nil {
+		return
+	}
+	if r.w.Started() && (r.rotateSoon || now.Sub(r.opened) >= r.rotate) && sink.KeyFrame(data.Data) {
+		r.next(now)
+	}
+	err := r.w.WriteVideo(now, data.Data, int(data.Width), int(data.Height))
+	if err == fmp4.ErrVideoChanged {
+		r.next(now)
+		err = r.w.WriteVideo(now, data.Data, int(data.Width), int(data.Height))
+	}
+	if err != nil {
+		r.fail(err)
+	}
+}
+
+func (r *mp4Recording) audioData(now time.Time, data protocol.AudioData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.active || !r.audio || r.err != nil || len(data.Data) == 0 {
+		return
+	}
+	if protocol.AudioDecodeTypes[data.DecodeType].Frequency == 0 {
+		return
+	}
+	stream := audioStream{decodeType: data.DecodeType, audioType: data.AudioType}
+	track, ok := r.tracks[stream]
+	if !ok {
+		known := false
+		for _, s := range r.streams {
+			known = known || s == stream
+		}
+		if !known {
+			r.streams = append(r.streams, stream)
+		}
+		// the next file gets a track for it
+		if !r.rotateSoon {
+			r.rotateSoon = true
+			r.requestKey()
+		}
+		return
+	}
+	if err := r.w.WriteAudio(track, now, data.Data); err != nil {
+		r.fail(err)
+	}
+}
+
+func (r *mp4Recording) status() recordingStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := recordingStatus{Active: r.active, Audio: r.audio, Dir: r.dir, Rotate: r.rotate.String(), Files: append([]string{}, r.files...)}
+	if r.active {
+		since := r.since
+		status.Since = &since
+		if r.file != nil && r.file.file != nil {
+			status.File = r.file.path
+		}
+	}
+	if r.err != nil {
+		status.Error = r.err.Error()
+	}
+	return status
+}
+
+// recordingHandler reports the MP4 recording (GET), starts it in -record-dir
+// (POST, optionally {"audio": true, "rotate": "10m"}) or stops it (DELETE).
+func (s *session) recordingHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.recording.status())
+	case http.MethodPost:
+		req := struct {
+			Audio  *bool  `json:"audio"`
+			Rotate string `json:"rotate"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		audio, rotate := cfg.RecordAudio, cfg.RecordRotate
+		if req.Audio != nil {
+			audio = *req.Audio
+		}
+		if req.Rotate != "" {
+			var err error
+			if rotate, err = time.ParseDuration(req.Rotate); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+		if err := s.recording.start(cfg.RecordDir, rotate, audio); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, s.recording.status())
+	case http.MethodDelete:
+		if err := s.recording.stop(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, s.recording.status())
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET, POST or DELETE"))
+	}
+}
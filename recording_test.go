@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"webrtc/protocol"
+	"webrtc/usblink"
+)
+
+var (
+	testKeyFrame   = []byte{0, 0, 0, 1, 0x67, 0x42, 0xc0, 0x1f, 0xda, 0, 0, 0, 1, 0x68, 0xce, 0x3c, 0x80, 0, 0, 0, 1, 0x65, 0x88, 0x84}
+	testDeltaFrame = []byte{0, 0, 0, 1, 0x41, 0x9a, 0x02}
+)
+
+// sentLink is a running link keeping the messages sent to it.
+type sentLink struct {
+	mu   sync.Mutex
+	sent []interface{}
+}
+
+func (l *sentLink) Start(func(), func(protocol.VideoData), func(protocol.AudioData), func(interface{}), func(error)) error {
+	return nil
+}
+
+func (l *sentLink) Stop() {}
+
+func (l *sentLink) SendMessage(msg interface{}) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sent = append(l.sent, msg)
+	return nil
+}
+
+func (l *sentLink) SendMessageWait(msg interface{}) error {
+	return l.SendMessage(msg)
+}
+
+func (l *sentLink) Health() usblink.Health { return usblink.Health{Connected: true} }
+
+func (l *sentLink) Recover(usblink.Recovery) error { return nil }
+
+func (l *sentLink) keyFrameRequests() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, msg := range l.sent {
+		if carPlay, ok := msg.(*protocol.CarPlay); ok && carPlay.Type == protocol.RequestKeyFrame {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRecordingWaitsForKeyFrame(t *testing.T) {
+	dir := t.TempDir()
+	wanted := 0
+	r := mp4Recording{name: "test", wantKey: func() { wanted++ }}
+	if err := r.start(dir, time.Minute, false); err != nil {
+		t.Fatal(err)
+	}
+	if wanted != 1 {
+		t.Fatalf("asked for %d keyframes at the start, want 1", wanted)
+	}
+
+	now := time.Unix(1700000000, 0)
+	r.video(now, protocol.VideoData{Width: 800, Height: 480, Data: testDeltaFrame})
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatal("a file was created before the keyframe")
+	}
+	r.video(now.Add(time.Second/30), protocol.VideoData{Width: 800, Height: 480, Data: testKeyFrame})
+	r.video(now.Add(2*time.Second/30), protocol.VideoData{Width: 800, Height: 480, Data: testDeltaFrame})
+	if status := r.status(); !status.Active || status.File == "" {
+		t.Fatalf("no file after the keyframe: %+v", status)
+	}
+	if err := r.stop(); err != nil {
+		t.Fatal(err)
+	}
+	if status := r.status(); len(status.Files) != 1 || status.Error != "" {
+		t.Fatalf("unexpected status after stop: %+v", status)
+	}
+}
+
+func TestRecordingHandlerAsksForKeyFrame(t *testing.T) {
+	cfg.RecordDir, cfg.RecordRotate = t.TempDir(), time.Minute
+	link := &sentLink{}
+	s := newSession("test", usblink.Selector{})
+	s.usbLink = link
+
+	rec := httptest.NewRecorder()
+	s.recordingHandler(rec, httptest.NewRequest(http.MethodPost, "/api/recording", strings.NewReader(`{"rotate": "5m"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("POST: %d %s", rec.Code, rec.Body)
+	}
+	if n := link.keyFrameRequests(); n != 1 {
+		t.Fatalf("asked the dongle for %d keyframes, want 1", n)
+	}
+
+	s.onVideo(protocol.VideoData{Width: 800, Height: 480, Data: testKeyFrame})
+	if status := s.recording.status(); status.File == "" || status.Rotate != "5m0s" {
+		t.Fatalf("recording did not start on the keyframe: %+v", status)
+	}
+
+	rec = httptest.NewRecorder()
+	s.recordingHandler(rec, httptest.NewRequest(http.MethodDelete, "/api/recording", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d %s", rec.Code, rec.Body)
+	}
+}
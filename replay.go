@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"webrtc/capture"
+	"webrtc/protocol"
+	"webrtc/usblink"
+)
+
+// runReplay is the replay command: it serves a capture to the viewers with
+// the recorded timing, the messages for the dongle are dropped.
+func runReplay(args []string) int {
+	fs := newFlagSet("replay")
+	loop := fs.Bool("loop", false, "start over at the end of the capture")
+	speed := fs.Float64("speed", 1, "playback speed factor")
+	cfg = loadConfig(fs, args)
+	if fs.NArg() != 1 || *speed <= 0 {
+		fs.Usage()
+		return 2
+	}
+	path := fs.Arg(0)
+	if err := checkCapture(path); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	s := newSession("default", usblink.Selector{})
+	s.newLink = func() dongleLink {
+		return &replayLink{path: path, loop: *loop, speed: *speed}
+	}
+	sessions = []*session{s}
+	if err := startSinks(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return listen()
+}
+
+// checkCapture fails early on files that are not captures.
+func checkCapture(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := capture.NewReader(file); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// playCapture decodes the messages the dongle sent in a capture and hands
+// them to deliver when they are due, speed times faster than recorded. It
+// returns io.EOF at the end of the capture and nil when stop is closed.
+func playCapture(path string, speed float64, stop <-chan struct{}, deliver func(msg interface{})) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	r, err := capture.NewReader(file)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	for {
+		rec, err := r.Next()
+		if err != nil {
+			return err
+		}
+		if rec.Dir != capture.In {
+			continue
+		}
+		_, msg, err := protocol.Decode(rec.Data)
+		if err != nil {
+			log.Printf("[replay] %s at %s\n", err, rec.Time)
+			continue
+		}
+		due := time.Duration(float64(rec.Time) / speed)
+		if wait := due - time.Since(start); wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-stop:
+				return nil
+			}
+		}
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		deliver(msg)
+	}
+}
+
+// replayLink plays a capture instead of talking to a dongle.
+type replayLink struct {
+	path  string
+	loop  bool
+	speed float64
+
+	mu    sync.Mutex
+	stop  chan struct{}
+	done  chan struct{}
+	since time.Time
+}
+
+func (l *replayLink) Start(onReadySend func(), onVideo func(protocol.VideoData), onAudio func(protocol.AudioData), onData func(interface{}), onError func(error)) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop != nil {
+		return nil
+	}
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+	l.since = time.Now()
+	callbacks := linkCallbacks{onReadySend, onVideo, onAudio, onData, onError}
+	go l.run(callbacks, l.stop, l.done)
+	return nil
+}
+
+func (l *replayLink) run(callbacks linkCallbacks, stop, done chan struct{}) {
+	defer close(done)
+	callbacks.onReadySend()
+	for {
+		err := playCapture(l.path, l.speed, stop, callbacks.deliver)
+		if err == nil {
+			return
+		}
+		if err != io.EOF {
+			callbacks.onError(err)
+			return
+		}
+		if !l.loop {
+			log.Printf("[replay] end of %s\n", l.path)
+			return
+		}
+	}
+}
+
+func (l *replayLink) Stop() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	l.stop = nil
+}
+
+// SendMessage drops the message, the capture plays on regardless.
+func (l *replayLink) SendMessage(msg interface{}) error {
+	return nil
+}
+
+func (l *replayLink) SendMessageWait(msg interface{}) error {
+	return l.SendMessage(msg)
+}
+
+func (l *replayLink) Health() usblink.Health {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stop == nil {
+		return usblink.Health{}
+	}
+	since := l.since
+	return usblink.Health{Connected: true, Since: &since, Device: "replay:" + l.path}
+}
+
+func (l *replayLink) Recover(r usblink.Recovery) error {
+	return errors.New("a replay cannot recover")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+	"webrtc/protocol"
+	"webrtc/touch"
+)
+
+// resizeDelay collects the resize messages of a window drag into a single
+// renegotiation; every Open restarts the phone's video stream.
+const resizeDelay = 500 * time.Millisecond
+
+func (s *session) viewerSize() deviceSize {
+	s.sizeMu.Lock()
+	defer s.sizeMu.Unlock()
+	return s.size
+}
+
+// touchLayout describes how the viewer shows the current frames, for mapping
+// touches made on a view of the given size.
+func (s *session) touchLayout(viewWidth, viewHeight float32) touch.Layout {
+	s.sizeMu.Lock()
+	frame := s.frameSize
+	if frame.Width <= 0 || frame.Height <= 0 {
+		frame = s.size
+	}
+	s.sizeMu.Unlock()
+
+	return touch.Layout{
+		ViewWidth:   float64(viewWidth),
+		ViewHeight:  float64(viewHeight),
+		FrameWidth:  float64(frame.Width),
+		FrameHeight: float64(frame.Height),
+		Fit:         cfg.VideoFit,
+		Rotation:    cfg.VideoRotation,
+		MirrorX:     cfg.VideoMirrorX,
+		MirrorY:     cfg.VideoMirrorY,
+	}
+}
+
+func (s *session) setViewerSize(newSize deviceSize) {
+	s.sizeMu.Lock()
+	defer s.sizeMu.Unlock()
+	s.size = newSize
+}
+
+// resizeCarPlay handles a resize message from the viewer and, after things
+// calm down, re-runs the Open handshake with the new size.
+func (s *session) resizeCarPlay(data []byte) {
+	var newSize deviceSize
+	if err := json.Unmarshal(data, &newSize); err != nil || newSize.Width <= 0 || newSize.Height <= 0 {
+		return
+	}
+
+	s.sizeMu.Lock()
+	defer s.sizeMu.Unlock()
+	if s.resizeTimer != nil {
+		s.resizeTimer.Stop()
+	}
+	s.resizeTimer = time.AfterFunc(resizeDelay, func() {
+		if s.viewerSize() == newSize {
+			return
+		}
+		s.setViewerSize(newSize)
+		if s.link() == nil || s.status.get().Dongle != dongleReady {
+			// not started yet, the new size is used by the first Open
+			return
+		}
+		log.Println("viewer resized, reopening", newSize.Width, newSize.Height)
+		s.initCarplay(newSize.Width, newSize.Height, fps, carPlayDPI)
+	})
+}
+
+// trackFrameSize notices frames whose size differs from the previous ones,
+// which happens after a resize or when the phone picks its own resolution,
+// and tells the viewers about it.
+func (s *session) trackFrameSize(data protocol.VideoData) {
+	current := deviceSize{Width: data.Width, Height: data.Height}
+	s.sizeMu.Lock()
+	changed := current != s.frameSize
+	s.frameSize = current
+	requested := s.size
+	s.sizeMu.Unlock()
+
+	if !changed {
+		return
+	}
+	if current != requested {
+		log.Printf("video frames are %dx%d, requested %dx%d\n", current.Width, current.Height, requested.Width, requested.Height)
+	}
+	s.events.publish("video", current)
+}
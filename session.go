@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"webrtc/capture"
+	"webrtc/hls"
+	"webrtc/sink"
+	"webrtc/touch"
+	"webrtc/usblink"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/websocket"
+)
+
+// session is one dongle with everything served for it. Each session has its
+// own endpoints under /dongle/<name>/, the first one is also served at /.
+type session struct {
+	name   string
+	prefix string
+	device usblink.Selector
+
+	events     eventHub
+	status     statusState
+	bluetooth  bluetoothState
+	nowPlaying nowPlayingState
+
+	// tracksMu guards the video tracks the viewers share and their audio
+	// channels, which the dongle callbacks write to.
+	tracksMu      sync.Mutex
+	videoTrack    *webrtc.TrackLocalStaticSample
+	naviTrack     *webrtc.TrackLocalStaticSample
+	audioChannels map[*webrtc.DataChannel]bool
+
+	// linkMu guards the link to the dongle and its touch pipeline, which
+	// the first viewer or a headless start sets up.
+	linkMu        sync.Mutex
+	usbLink       dongleLink
+	touchPipeline *touch.Pipeline
+	touchStop     chan struct{}
+
+	// touchActive tells whether the gesture under way began on the video,
+	// the viewers' touches come from data channels and WebSockets alike.
+	touchMu     sync.Mutex
+	touchActive bool
+
+	// newLink replaces the USB link, recorder captures its traffic.
+	newLink   func() dongleLink
+	recorder  *capture.Writer
+	recording mp4Recording
+
+	sinksMu sync.Mutex
+	sinks   []sink.Sink
+
+	hlsMu   sync.Mutex
+	hls     *hls.Stream
+	hlsUsed time.Time
+
+	// whep are the peer connections of the WHEP players by resource id.
+	whepMu sync.Mutex
+	whep   map[string]*webrtc.PeerConnection
+
+	sizeMu      sync.Mutex
+	size        deviceSize
+	frameSize   deviceSize
+	resizeTimer *time.Timer
+	// androidAdapted tells whether an Android phone in CarPlay mode got
+	// the Android Auto layout.
+	androidAdapted bool
+}
+
+var sessions []*session
+
+var sessionName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func newSession(name string, device usblink.Selector) *session {
+	s := &session{name: name, prefix: "/dongle/" + name, device: device}
+	s.status.events = &s.events
+	s.status.status = dongleStatus{
+		Dongle:     dongleStopped,
+		Connection: phoneConnection{State: "unplugged"},
+		Wifi:       wifiStatus{Band: cfg.WifiBand, Channel: cfg.WifiChannel},
+	}
+	s.bluetooth.events = &s.events
+	s.bluetooth.info.AutoConnect = strings.ToUpper(cfg.AutoConnect)
+	s.nowPlaying.events = &s.events
+	s.nowPlaying.artPath = s.prefix + "/api/nowplaying/art"
+	s.recording.name = name
+	s.recording.wantKey = s.requestKeyFrame
+	return s
+}
+
+func (s *session) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/connect", s.webRTCOfferHandler)
+	mux.HandleFunc("/api/nowplaying", s.nowPlayingHandler)
+	mux.HandleFunc("/api/nowplaying/art", s.albumArtHandler)
+	mux.HandleFunc("/api/status", s.statusHandler)
+	mux.HandleFunc("/api/boxsettings", s.boxSettingsHandler)
+	mux.HandleFunc("/api/events", s.eventsHandler)
+	mux.HandleFunc("/api/wifi", s.wifiHandler)
+	mux.HandleFunc("/api/touch", s.touchStatsHandler)
+	mux.HandleFunc("/api/health", s.healthHandler)
+	mux.HandleFunc("/api/bluetooth", s.bluetoothHandler)
+	mux.HandleFunc("/api/bluetooth/paired/", s.pairedDeviceHandler)
+	mux.HandleFunc("/api/bluetooth/autoconnect", s.autoConnectHandler)
+	mux.HandleFunc("/api/button", s.buttonHandler)
+	mux.HandleFunc("/api/recording", s.recordingHandler)
+	mux.HandleFunc("/api/ice", iceHandler)
+	mux.Handle("/ws", websocket.Handler(s.serveWS))
+	mux.Handle("/signal", websocket.Handler(s.serveSignal))
+	mux.HandleFunc("/hls/", s.hlsHandler)
+	mux.HandleFunc("/whep", s.whepHandler)
+	mux.HandleFunc("/whep/", s.whepResourceHandler)
+	mux.Handle("/", NoCache(http.FileServer(http.Dir("./"))))
+	return mux
+}
+
+// sessionInfo is an entry of the /api/dongles list.
+type sessionInfo struct {
+	Name   string         `json:"name"`
+	Path   string         `json:"path"`
+	Device string         `json:"device"`
+	Status dongleStatus   `json:"status"`
+	Health usblink.Health `json:"health"`
+}
+
+func (s *session) info() sessionInfo {
+	info := sessionInfo{
+		Name:   s.name,
+		Path:   s.prefix + "/",
+		Device: s.device.String(),
+		Status: s.status.get(),
+	}
+	if link := s.link(); link != nil {
+		info.Health = link.Health()
+	}
+	return info
+}
+
+func donglesHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]sessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s.info())
+	}
+	writeJSON(w, list)
+}
+
+// dongleFlags collects the -dongle flags, name=selector each. A bare
+// selector names the dongle "default".
+type dongleFlags []dongleConfig
+
+type dongleConfig struct {
+	Name   string
+	Device usblink.Selector
+}
+
+func (d *dongleFlags) String() string {
+	var parts []string
+	for _, dongle := range *d {
+		parts = append(parts, dongle.Name+"="+dongle.Device.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (d *dongleFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) == 1 {
+		parts = []string{"default", value}
+	}
+	if !sessionName.MatchString(parts[0]) {
+		return fmt.Errorf("want name=selector, got %q", value)
+	}
+	for _, dongle := range *d {
+		if dongle.Name == parts[0] {
+			return fmt.Errorf("dongle %q is given twice", parts[0])
+		}
+	}
+	device, err := usblink.ParseSelector(parts[1])
+	if err != nil {
+		return err
+	}
+	*d = append(*d, dongleConfig{Name: parts[0], Device: device})
+	return nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/websocket"
+)
+
+// signalMessage is a message of the WebSocket signalling. It begins with a
+// "config" of the ICE servers the viewer is to use. The viewer sends
+// "offer"s, the first one and any later one renegotiating or restarting
+// ICE, and gets an "answer" to each. Both sides trickle their "candidate"s,
+// one without a candidate ending them. "error" reports a failed step.
+type signalMessage struct {
+	Type      string                   `json:"type"`
+	SDP       string                   `json:"sdp,omitempty"`
+	Candidate *webrtc.ICECandidateInit `json:"candidate,omitempty"`
+	Message   string                   `json:"message,omitempty"`
+
+	ICEServers []webrtc.ICEServer `json:"iceServers,omitempty"`
+}
+
+// serveSignal is the trickle ICE signalling of a viewer, ?stream=navi
+// selecting the instrument cluster stream. The peer connection lives as
+// long as the WebSocket.
+func (s *session) serveSignal(conn *websocket.Conn) {
+	defer conn.Close()
+	send := func(msg signalMessage) {
+		websocket.JSON.Send(conn, msg)
+	}
+
+	send(signalMessage{Type: "config", ICEServers: viewerICEServers()})
+
+	pc, err := s.newViewer(conn.Request().URL.Query().Get("stream"))
+	if err != nil {
+		send(signalMessage{Type: "error", Message: err.Error()})
+		return
+	}
+	defer pc.Close()
+	// our candidates may only follow the answer they belong to
+	var answering sync.Mutex
+	pc.OnICECandidate(func(c *webrtc.ICECandidate) {
+		answering.Lock()
+		defer answering.Unlock()
+		if c == nil {
+			send(signalMessage{Type: "candidate"})
+			return
+		}
+		candidate := c.ToJSON()
+		send(signalMessage{Type: "candidate", Candidate: &candidate})
+	})
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		// nothing plays the viewer's media yet, it is read and dropped
+		log.Printf("[signal] %s: viewer sends %s\n", s.name, track.Codec().MimeType)
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := track.Read(buf); err != nil {
+				return
+			}
+		}
+	})
+
+	// candidates that come before their offer wait for it
+	var early []webrtc.ICECandidateInit
+	for {
+		var msg signalMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "offer":
+			answering.Lock()
+			answer, err := answerOffer(pc, msg.SDP)
+			if err != nil {
+				answering.Unlock()
+				send(signalMessage{Type: "error", Message: err.Error()})
+				continue
+			}
+			send(signalMessage{Type: "answer", SDP: answer})
+			answering.Unlock()
+			for _, candidate := range early {
+				pc.AddICECandidate(candidate)
+			}
+			early = nil
+		case "candidate":
+			switch {
+			case msg.Candidate == nil:
+			case pc.RemoteDescription() == nil:
+				early = append(early, *msg.Candidate)
+			default:
+				if err := pc.AddICECandidate(*msg.Candidate); err != nil {
+					send(signalMessage{Type: "error", Message: err.Error()})
+				}
+			}
+		}
+	}
+}
+
+// answerOffer applies an offer of the viewer. An offer with new ICE
+// credentials restarts ICE, the answer then carries new ones too.
+func answerOffer(pc *webrtc.PeerConnection, sdp string) (string, error) {
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: sdp}); err != nil {
+		return "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	return answer.SDP, nil
+}
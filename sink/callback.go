@@ -0,0 +1,40 @@
+package sink
+
+import "io"
+
+// Callback hands the frames to a function on a goroutine of its own, for
+// outputs living outside this package such as WebSocket viewers.
+type Callback struct {
+	q    *queue
+	done chan struct{}
+}
+
+// NewCallback calls write for every frame, from a keyframe on, until write
+// fails or the sink is closed. wantKey, which may be nil, asks for a
+// keyframe.
+func NewCallback(write func(Frame) error, wantKey func()) *Callback {
+	c := &Callback{q: newQueue(wantKey), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		c.q.copyTo(nil, func(_ io.Writer, f Frame) error {
+			return write(f)
+		})
+		c.q.close()
+	}()
+	return c
+}
+
+func (c *Callback) Write(f Frame) {
+	c.q.push(f)
+}
+
+// Done is closed once write failed or the queued frames after Close are
+// written.
+func (c *Callback) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Callback) Close() error {
+	c.q.close()
+	return nil
+}
@@ -0,0 +1,91 @@
+package sink
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// restartDelay keeps a process that fails at once from being respawned in a
+// tight loop.
+const restartDelay = time.Second
+
+// Process pipes the stream to the stdin of a command, which is started again
+// when it exits. Its stdout and stderr go to ours.
+type Process struct {
+	args []string
+	q    *queue
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Exec starts command, split into its arguments at white space, e.g.
+// "ffplay -f h264 -". wantKey, which may be nil, asks for a keyframe.
+func Exec(command string, wantKey func()) (*Process, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty sink command")
+	}
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return nil, err
+	}
+	p := &Process{args: args, q: newQueue(wantKey), stop: make(chan struct{})}
+	go p.run()
+	return p, nil
+}
+
+func (p *Process) run() {
+	for {
+		err := p.runOnce()
+		if err == nil {
+			return
+		}
+		log.Printf("[sink] %s: %s, restarting\n", p.args[0], err)
+		p.q.restart()
+		select {
+		case <-time.After(restartDelay):
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// runOnce runs the command until the sink is closed, which returns nil, or
+// until the command stops reading.
+func (p *Process) runOnce() error {
+	cmd := exec.Command(p.args[0], p.args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	err = p.q.copyTo(stdin, writeAnnexB)
+	stdin.Close()
+	if err != nil {
+		cmd.Process.Kill()
+	}
+	if waitErr := cmd.Wait(); err == nil && waitErr != nil {
+		log.Printf("[sink] %s: %s\n", p.args[0], waitErr)
+	}
+	return err
+}
+
+func (p *Process) Write(f Frame) {
+	p.q.push(f)
+}
+
+// Close closes the command's stdin, a player is expected to exit then.
+func (p *Process) Close() error {
+	p.stopOnce.Do(func() { close(p.stop) })
+	p.q.close()
+	return nil
+}
@@ -0,0 +1,64 @@
+package sink
+
+import (
+	"log"
+	"os"
+)
+
+// File writes the stream into a file or a named pipe. A named pipe is
+// reopened when its reader goes away, the next reader starts at a keyframe.
+type File struct {
+	path string
+	q    *queue
+}
+
+// OpenFile starts writing to path. The file is opened in the background
+// since opening a named pipe waits for a reader. wantKey, which may be nil,
+// asks for a keyframe.
+func OpenFile(path string, wantKey func()) *File {
+	f := &File{path: path, q: newQueue(wantKey)}
+	go f.run()
+	return f
+}
+
+func (f *File) run() {
+	for {
+		file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			log.Printf("[sink] %s\n", err)
+			f.drain()
+			return
+		}
+		info, _ := file.Stat()
+		pipe := info != nil && info.Mode()&os.ModeNamedPipe != 0
+		err = f.q.copyTo(file, writeAnnexB)
+		file.Close()
+		if err == nil {
+			return
+		}
+		if !pipe {
+			log.Printf("[sink] %s\n", err)
+			f.drain()
+			return
+		}
+		log.Printf("[sink] reader of %s left, waiting for the next one\n", f.path)
+		f.q.restart()
+	}
+}
+
+// drain discards the frames after a failure until the sink is closed.
+func (f *File) drain() {
+	for range f.q.frames {
+	}
+}
+
+func (f *File) Write(frame Frame) {
+	f.q.push(frame)
+}
+
+// Close stops writing. A named pipe that never got a reader is left alone,
+// the open waiting for one is abandoned.
+func (f *File) Close() error {
+	f.q.close()
+	return nil
+}
@@ -0,0 +1,174 @@
+// Package sink writes the H.264 video of a session to players that do not
+// speak WebRTC: files and named pipes, the clients of a Unix socket and the
+// stdin of a spawned process.
+//
+// Every sink has its own queue, a slow reader never holds up the dongle. When
+// a queue overflows its sink skips frames up to the next keyframe, so the
+// reader's decoder resumes on a clean picture. Whenever a sink waits for a
+// keyframe it asks the source for one through the wantKey function given to
+// it, the phone sending them rarely by itself.
+package sink
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Frame is an access unit of the video stream, Annex-B formatted as the
+// dongle sends it.
+type Frame struct {
+	Time   time.Time
+	Width  int
+	Height int
+	Data   []byte
+}
+
+// Sink receives the frames of a session. Write never blocks.
+type Sink interface {
+	Write(f Frame)
+	Close() error
+}
+
+// queueSize is the number of frames a sink buffers, about a second of video.
+const queueSize = 32
+
+// Open creates the sink described by spec:
+//
+//	file:<path>    Annex-B H.264 into a file or named pipe
+//	unix:<path>    a Unix socket serving length-prefixed frames
+//	exec:<command> a process reading Annex-B H.264 on stdin
+//
+// wantKey, which may be nil, asks for a keyframe.
+func Open(spec string, wantKey func()) (Sink, error) {
+	kind, target, err := ParseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case "file":
+		return OpenFile(target, wantKey), nil
+	case "unix":
+		return Listen(target, wantKey)
+	default:
+		return Exec(target, wantKey)
+	}
+}
+
+// ParseSpec splits a sink spec into its kind and target.
+func ParseSpec(spec string) (kind, target string, err error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", fmt.Errorf("invalid sink %q, want file:<path>, unix:<path> or exec:<command>", spec)
+	}
+	switch parts[0] {
+	case "file", "unix", "exec":
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("unknown sink kind %q, want file, unix or exec", parts[0])
+}
+
+// KeyFrame reports whether an access unit holds an IDR slice or a sequence
+// parameter set, a point where a decoder can start.
+func KeyFrame(data []byte) bool {
+	for i := 0; i+3 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		switch data[i+3] & 0x1f {
+		case 5, 7:
+			return true
+		}
+		i += 2
+	}
+	return false
+}
+
+// queue hands frames from the video callback to a writer goroutine.
+type queue struct {
+	frames  chan Frame
+	wantKey func()
+
+	mu      sync.Mutex
+	closed  bool
+	waitKey bool
+}
+
+func newQueue(wantKey func()) *queue {
+	// a reader joining mid-stream cannot decode before a keyframe
+	return &queue{frames: make(chan Frame, queueSize), wantKey: wantKey, waitKey: true}
+}
+
+// push queues f unless the queue is full, after which it drops frames up to
+// the next keyframe.
+func (q *queue) push(f Frame) {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return
+	}
+	if q.waitKey {
+		if !KeyFrame(f.Data) {
+			q.mu.Unlock()
+			return
+		}
+		q.waitKey = false
+	}
+	select {
+	case q.frames <- f:
+		q.mu.Unlock()
+	default:
+		q.waitKey = true
+		q.mu.Unlock()
+		q.requestKey()
+	}
+}
+
+// restart makes the queue wait for a keyframe again, for a new reader.
+func (q *queue) restart() {
+	q.mu.Lock()
+	q.waitKey = true
+	for drained := false; !drained; {
+		select {
+		case _, ok := <-q.frames:
+			drained = !ok
+		default:
+			drained = true
+		}
+	}
+	q.mu.Unlock()
+	q.requestKey()
+}
+
+func (q *queue) requestKey() {
+	if q.wantKey != nil {
+		q.wantKey()
+	}
+}
+
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.closed = true
+		close(q.frames)
+	}
+}
+
+// copyTo writes the queued frames to w until the queue is closed, which
+// returns nil, or until a write fails.
+func (q *queue) copyTo(w io.Writer, encode func(io.Writer, Frame) error) error {
+	for f := range q.frames {
+		if err := encode(w, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeAnnexB(w io.Writer, f Frame) error {
+	_, err := w.Write(f.Data)
+	return err
+}
@@ -0,0 +1,160 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	keyFrame   = []byte{0, 0, 0, 1, 0x67, 1, 2, 0, 0, 0, 1, 0x68, 3, 0, 0, 1, 0x65, 4}
+	deltaFrame = []byte{0, 0, 0, 1, 0x41, 5, 6}
+)
+
+func TestKeyFrame(t *testing.T) {
+	if !KeyFrame(keyFrame) {
+		t.Error("SPS, PPS and IDR not seen as a keyframe")
+	}
+	if KeyFrame(deltaFrame) {
+		t.Error("a P slice seen as a keyframe")
+	}
+	if KeyFrame(nil) {
+		t.Error("an empty frame seen as a keyframe")
+	}
+}
+
+func TestQueueWaitsForKeyFrame(t *testing.T) {
+	wanted := 0
+	q := newQueue(func() { wanted++ })
+	q.push(Frame{Data: deltaFrame})
+	q.push(Frame{Data: keyFrame})
+	q.push(Frame{Data: deltaFrame})
+	for i := 0; i < queueSize; i++ {
+		q.push(Frame{Data: deltaFrame})
+	}
+	// the queue overflowed, the next frames are dropped up to a keyframe
+	q.push(Frame{Data: deltaFrame})
+	if len(q.frames) != queueSize {
+		t.Fatalf("queued %d frames, want %d", len(q.frames), queueSize)
+	}
+	if wanted != 1 {
+		t.Fatalf("asked for %d keyframes after the overflow, want 1", wanted)
+	}
+	if f := <-q.frames; !bytes.Equal(f.Data, keyFrame) {
+		t.Fatal("the first queued frame is not the keyframe")
+	}
+	q.push(Frame{Data: deltaFrame})
+	if len(q.frames) != queueSize-1 {
+		t.Fatal("a frame was queued after an overflow without a keyframe")
+	}
+	q.close()
+	q.push(Frame{Data: keyFrame})
+}
+
+func TestParseSpec(t *testing.T) {
+	for _, spec := range []string{"file:/tmp/x.h264", "unix:/run/carplay.sock", "exec:ffplay -f h264 -"} {
+		if _, _, err := ParseSpec(spec); err != nil {
+			t.Errorf("ParseSpec(%q): %v", spec, err)
+		}
+	}
+	for _, spec := range []string{"", "file:", "/tmp/x.h264", "tcp:localhost:1234"} {
+		if _, _, err := ParseSpec(spec); err == nil {
+			t.Errorf("ParseSpec(%q) succeeded", spec)
+		}
+	}
+}
+
+func TestFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.h264")
+	f := OpenFile(path, nil)
+	f.Write(Frame{Data: keyFrame})
+	f.Write(Frame{Data: deltaFrame})
+	f.Close()
+
+	want := append(append([]byte{}, keyFrame...), deltaFrame...)
+	deadline := time.Now().Add(time.Second)
+	for {
+		data, _ := os.ReadFile(path)
+		if bytes.Equal(data, want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("file holds %x, want %x", data, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSocket(t *testing.T) {
+	wanted := make(chan struct{}, 1)
+	s, err := Listen(filepath.Join(t.TempDir(), "video.sock"), func() { wanted <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	conn, err := net.Dial("unix", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	now := time.Unix(1700000000, 123456000)
+	// the server asks for a keyframe once it registered the client
+	select {
+	case <-wanted:
+	case <-time.After(time.Second):
+		t.Fatal("no keyframe asked for the new client")
+	}
+	s.Write(Frame{Time: now, Data: deltaFrame})
+	s.Write(Frame{Time: now, Data: keyFrame})
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var head [12]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		t.Fatal(err)
+	}
+	if n := binary.BigEndian.Uint32(head[0:]); n != uint32(len(keyFrame)) {
+		t.Fatalf("length %d, want %d", n, len(keyFrame))
+	}
+	if ts := int64(binary.BigEndian.Uint64(head[4:])); ts != now.UnixNano()/1000 {
+		t.Fatalf("timestamp %d, want %d", ts, now.UnixNano()/1000)
+	}
+	data := make([]byte, len(keyFrame))
+	if _, err := io.ReadFull(conn, data); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, keyFrame) {
+		t.Fatalf("got %x, want the keyframe", data)
+	}
+}
+
+func TestCallback(t *testing.T) {
+	got := make(chan Frame, 2)
+	c := NewCallback(func(f Frame) error {
+		got <- f
+		return io.ErrClosedPipe
+	}, nil)
+	c.Write(Frame{Data: deltaFrame})
+	c.Write(Frame{Data: keyFrame, Width: 800})
+	select {
+	case f := <-got:
+		if f.Width != 800 {
+			t.Fatalf("got %+v, want the keyframe", f)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write not called")
+	}
+	// a failed write ends the callback
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("callback still running after a failed write")
+	}
+	c.Write(Frame{Data: keyFrame})
+	c.Close()
+}
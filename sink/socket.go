@@ -0,0 +1,108 @@
+package sink
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// Socket serves the stream on a Unix domain socket. Every client gets the
+// frames from the next keyframe on, each one as a packet of
+//
+//	length    uint32, big endian, the size of data
+//	timestamp int64, big endian, microseconds since the Unix epoch
+//	data      the Annex-B access unit
+type Socket struct {
+	ln      net.Listener
+	wantKey func()
+
+	mu      sync.Mutex
+	clients map[*queue]bool
+	closed  bool
+}
+
+// Listen creates the socket at path, replacing a stale socket file.
+// wantKey, which may be nil, asks for a keyframe.
+func Listen(path string, wantKey func()) (*Socket, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Socket{ln: ln, wantKey: wantKey, clients: make(map[*queue]bool)}
+	go s.accept()
+	return s, nil
+}
+
+// Addr is the address the socket listens on.
+func (s *Socket) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+func (s *Socket) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		q := newQueue(s.wantKey)
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.clients[q] = true
+		s.mu.Unlock()
+		// the client can only start at a keyframe
+		q.requestKey()
+		go s.serve(conn, q)
+	}
+}
+
+func (s *Socket) serve(conn net.Conn, q *queue) {
+	defer conn.Close()
+	if err := q.copyTo(conn, writePacket); err != nil {
+		log.Printf("[sink] socket client left: %s\n", err)
+	}
+	s.mu.Lock()
+	delete(s.clients, q)
+	s.mu.Unlock()
+	q.close()
+}
+
+func writePacket(w io.Writer, f Frame) error {
+	var head [12]byte
+	binary.BigEndian.PutUint32(head[0:], uint32(len(f.Data)))
+	binary.BigEndian.PutUint64(head[4:], uint64(f.Time.UnixNano()/1000))
+	if _, err := w.Write(head[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(f.Data)
+	return err
+}
+
+func (s *Socket) Write(f Frame) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for q := range s.clients {
+		q.push(f)
+	}
+}
+
+// Close stops listening and disconnects the clients once their queued
+// frames are written.
+func (s *Socket) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for q := range s.clients {
+		q.close()
+	}
+	s.mu.Unlock()
+	return s.ln.Close()
+}
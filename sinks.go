@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"webrtc/sink"
+)
+
+// openSinks starts the -sink outputs of the session, {dongle} in a spec
+// standing for the session name.
+func (s *session) openSinks() error {
+	var opened []sink.Sink
+	for _, spec := range cfg.Sinks {
+		out, err := sink.Open(strings.ReplaceAll(spec, "{dongle}", s.name), s.requestKeyFrame)
+		if err != nil {
+			s.closeSinks(opened)
+			return err
+		}
+		s.addSink(out)
+		opened = append(opened, out)
+	}
+	return nil
+}
+
+func (s *session) closeSinks(sinks []sink.Sink) {
+	for _, out := range sinks {
+		s.removeSink(out)
+		out.Close()
+	}
+}
+
+// addSink attaches out and, as a sink starts at a keyframe, asks the phone
+// for one.
+func (s *session) addSink(out sink.Sink) {
+	s.sinksMu.Lock()
+	s.sinks = append(s.sinks, out)
+	s.sinksMu.Unlock()
+	s.requestKeyFrame()
+}
+
+// removeSink detaches out, closing it is up to the caller.
+func (s *session) removeSink(out sink.Sink) {
+	s.sinksMu.Lock()
+	defer s.sinksMu.Unlock()
+	for i, other := range s.sinks {
+		if other == out {
+			s.sinks = append(s.sinks[:i:i], s.sinks[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *session) writeSinks(frame sink.Frame) {
+	s.sinksMu.Lock()
+	defer s.sinksMu.Unlock()
+	for _, out := range s.sinks {
+		out.Write(frame)
+	}
+}
+
+// startHeadless starts the dongle without waiting for a viewer, with the
+// -width and -height screen size, unless it runs already. Viewers joining
+// later resize it.
+func (s *session) startHeadless() {
+	s.start(deviceSize{Width: int32(cfg.Width), Height: int32(cfg.Height)})
+}
+
+// startSinks opens the -sink outputs of every session and, as the sinks want
+// video before any viewer shows up, starts the dongles.
+func startSinks() error {
+	if len(cfg.Sinks) == 0 {
+		return nil
+	}
+	for _, s := range sessions {
+		if err := s.openSinks(); err != nil {
+			return err
+		}
+		s.startHeadless()
+	}
+	return nil
+}
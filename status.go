@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+	"webrtc/protocol"
+)
+
+// Dongle states reported in dongleStatus.Dongle and "dongle" events.
+const (
+	dongleStopped   = "stopped"
+	dongleSearching = "searching"
+	dongleReady     = "ready"
+)
+
+// phoneConnection is the payload of "phone" events.
+type phoneConnection struct {
+	State    string `json:"state"` // plugged or unplugged
+	Type     string `json:"type,omitempty"`
+	Wireless bool   `json:"wireless"`
+}
+
+type dongleStatus struct {
+	Dongle          string              `json:"dongle"`
+	Connection      phoneConnection     `json:"connection"`
+	Wifi            wifiStatus          `json:"wifi"`
+	SoftwareVersion string              `json:"softwareVersion,omitempty"`
+	Box             *protocol.BoxInfo   `json:"box,omitempty"`
+	Phone           *protocol.PhoneInfo `json:"phone,omitempty"`
+}
+
+type statusState struct {
+	mu     sync.Mutex
+	status dongleStatus
+	events *eventHub
+}
+
+func (s *statusState) get() dongleStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+func (s *statusState) update(fn func(*dongleStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&s.status)
+}
+
+func (s *statusState) onData(data interface{}) {
+	s.onWifiData(data)
+	switch data := data.(type) {
+	case *protocol.SoftwareVersion:
+		s.update(func(st *dongleStatus) {
+			st.SoftwareVersion = trimNull(data.Version)
+		})
+	case *protocol.BoxSettings:
+		s.update(func(st *dongleStatus) {
+			if data.Box != nil {
+				st.Box = data.Box
+			}
+			if data.Phone != nil {
+				st.Phone = data.Phone
+			}
+		})
+	case *protocol.Plugged:
+		conn := phoneConnection{State: "plugged", Type: data.PhoneType.GoString(), Wireless: data.Wifi}
+		s.update(func(st *dongleStatus) {
+			st.Connection = conn
+		})
+		s.events.publish("phone", conn)
+	case *protocol.Unplugged:
+		conn := phoneConnection{State: "unplugged"}
+		s.update(func(st *dongleStatus) {
+			st.Connection = conn
+			st.Phone = nil
+		})
+		s.events.publish("phone", conn)
+	}
+}
+
+func (s *statusState) setDongle(state string) {
+	s.update(func(st *dongleStatus) {
+		st.Dongle = state
+	})
+	s.events.publish("dongle", map[string]string{"state": state})
+}
+
+func (s *statusState) onError(err error) {
+	s.events.publish("error", map[string]string{"message": err.Error()})
+}
+
+// statusEvents returns the current state as events, sent to browsers before
+// any change so they do not have to wait for the next plug or unplug.
+func (s *statusState) statusEvents() []event {
+	st := s.get()
+	now := time.Now()
+	return []event{
+		{Type: "dongle", Time: now, Data: map[string]string{"state": st.Dongle}},
+		{Type: "phone", Time: now, Data: st.Connection},
+		{Type: "wifi", Time: now, Data: st.Wifi},
+	}
+}
+
+func (s *session) statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.status.get())
+}
+
+// boxSettingsHandler sends a BoxSettings document to the dongle. A missing
+// syncTime is filled with the current time.
+func (s *session) boxSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	var config protocol.BoxConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	link := s.link()
+	if link == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("dongle is not started"))
+		return
+	}
+	if config.SyncTime == 0 {
+		config.SyncTime = time.Now().Unix()
+	}
+	settings, err := protocol.NewBoxSettings(config)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if err := link.SendMessage(settings); err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
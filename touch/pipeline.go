@@ -0,0 +1,142 @@
+package touch
+
+import (
+	"log"
+	"sync"
+	"time"
+	"webrtc/protocol"
+)
+
+// Pipeline queues touches for the dongle. Moves that pile up while the
+// previous packet is still being written are merged into the latest one,
+// presses and releases are always delivered in order, and moves are sent no
+// faster than MaxRate.
+type Pipeline struct {
+	maxRate int
+	send    func(*protocol.Touch) error
+
+	mu    sync.Mutex
+	queue []queued
+	wake  chan struct{}
+	stats Stats
+}
+
+type queued struct {
+	touch  protocol.Touch
+	queued time.Time
+}
+
+// Stats describes the pipeline's work so far. Latency is the time from Push
+// to the end of the write, for the oldest input a packet stands for.
+type Stats struct {
+	Pushed      uint64        `json:"pushed"`
+	Sent        uint64        `json:"sent"`
+	Coalesced   uint64        `json:"coalesced"`
+	Failed      uint64        `json:"failed"`
+	Queued      int           `json:"queued"`
+	LastLatency time.Duration `json:"lastLatency"`
+	MaxLatency  time.Duration `json:"maxLatency"`
+	AvgLatency  time.Duration `json:"avgLatency"`
+}
+
+// NewPipeline returns a pipeline handing touches to send, which is expected
+// to block until the packet is written. maxRate limits moves per second,
+// 0 means no limit.
+func NewPipeline(maxRate int, send func(*protocol.Touch) error) *Pipeline {
+	return &Pipeline{
+		maxRate: maxRate,
+		send:    send,
+		wake:    make(chan struct{}, 1),
+	}
+}
+
+func (p *Pipeline) Push(touch protocol.Touch) {
+	p.mu.Lock()
+	p.stats.Pushed++
+	if n := len(p.queue); n > 0 && touch.Action == protocol.TouchMove && p.queue[n-1].touch.Action == protocol.TouchMove {
+		// keep the older timestamp so latency covers the whole wait
+		p.queue[n-1].touch = touch
+		p.stats.Coalesced++
+	} else {
+		p.queue = append(p.queue, queued{touch: touch, queued: time.Now()})
+	}
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Pipeline) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := p.stats
+	stats.Queued = len(p.queue)
+	return stats
+}
+
+// Run delivers queued touches until stop is closed. A touch that cannot be
+// sent is dropped and the ones after it still go out.
+func (p *Pipeline) Run(stop <-chan struct{}) {
+	var (
+		interval time.Duration
+		lastMove time.Time
+	)
+	if p.maxRate > 0 {
+		interval = time.Second / time.Duration(p.maxRate)
+	}
+
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			select {
+			case <-p.wake:
+				continue
+			case <-stop:
+				return
+			}
+		}
+		next := p.queue[0]
+		// a lone move waits for its slot and may absorb newer moves meanwhile;
+		// one with a press or release behind it goes out at once
+		if next.touch.Action == protocol.TouchMove && len(p.queue) == 1 {
+			if wait := interval - time.Since(lastMove); wait > 0 {
+				p.mu.Unlock()
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return
+				}
+				continue
+			}
+		}
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		touch := next.touch
+		if err := p.send(&touch); err != nil {
+			log.Printf("[touch] %s\n", err)
+			p.mu.Lock()
+			p.stats.Failed++
+			p.mu.Unlock()
+			continue
+		}
+		if touch.Action == protocol.TouchMove {
+			lastMove = time.Now()
+		}
+		p.recordLatency(time.Since(next.queued))
+	}
+}
+
+func (p *Pipeline) recordLatency(latency time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.Sent++
+	p.stats.LastLatency = latency
+	if latency > p.stats.MaxLatency {
+		p.stats.MaxLatency = latency
+	}
+	p.stats.AvgLatency += (latency - p.stats.AvgLatency) / time.Duration(p.stats.Sent)
+}
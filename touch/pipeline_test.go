@@ -0,0 +1,120 @@
+package touch
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"webrtc/protocol"
+)
+
+func TestPipelineCoalescesMoves(t *testing.T) {
+	sent := make(chan protocol.Touch, 16)
+	release := make(chan struct{})
+	p := NewPipeline(0, func(touch *protocol.Touch) error {
+		sent <- *touch
+		<-release
+		return nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// the down is being written while the rest of the gesture arrives
+	p.Push(protocol.Touch{Action: protocol.TouchDown, X: 1})
+	go p.Run(stop)
+	if touch := <-sent; touch.Action != protocol.TouchDown {
+		t.Fatalf("first touch = %#v, want down", touch)
+	}
+	p.Push(protocol.Touch{Action: protocol.TouchMove, X: 2})
+	p.Push(protocol.Touch{Action: protocol.TouchMove, X: 3})
+	p.Push(protocol.Touch{Action: protocol.TouchMove, X: 4})
+	p.Push(protocol.Touch{Action: protocol.TouchUp, X: 5})
+	close(release)
+
+	want := []protocol.Touch{
+		{Action: protocol.TouchMove, X: 4},
+		{Action: protocol.TouchUp, X: 5},
+	}
+	for _, w := range want {
+		select {
+		case touch := <-sent:
+			if touch != w {
+				t.Fatalf("touch = %#v, want %#v", touch, w)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for %#v", w)
+		}
+	}
+	if stats := p.Stats(); stats.Coalesced != 2 || stats.Pushed != 5 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+}
+
+func TestPipelineRateLimit(t *testing.T) {
+	var sentAt []time.Time
+	done := make(chan struct{})
+	p := NewPipeline(20, func(touch *protocol.Touch) error {
+		sentAt = append(sentAt, time.Now())
+		if touch.Action == protocol.TouchUp {
+			close(done)
+		}
+		return nil
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	go p.Run(stop)
+
+	p.Push(protocol.Touch{Action: protocol.TouchDown})
+	for i := 0; i < 3; i++ {
+		p.Push(protocol.Touch{Action: protocol.TouchMove})
+		time.Sleep(60 * time.Millisecond)
+	}
+	p.Push(protocol.Touch{Action: protocol.TouchUp})
+	<-done
+
+	if len(sentAt) != 5 {
+		t.Fatalf("sent %d touches, want 5", len(sentAt))
+	}
+	for i := 2; i < 4; i++ {
+		if gap := sentAt[i].Sub(sentAt[i-1]); gap < 45*time.Millisecond {
+			t.Fatalf("moves %d and %d only %s apart", i-1, i, gap)
+		}
+	}
+}
+
+func TestPipelineSurvivesSendErrors(t *testing.T) {
+	sent := make(chan protocol.Touch, 4)
+	p := NewPipeline(0, func(touch *protocol.Touch) error {
+		if touch.Action == protocol.TouchDown {
+			return errors.New("queue full")
+		}
+		sent <- *touch
+		return nil
+	})
+	stop := make(chan struct{})
+	ran := make(chan struct{})
+	go func() {
+		p.Run(stop)
+		close(ran)
+	}()
+
+	p.Push(protocol.Touch{Action: protocol.TouchDown})
+	p.Push(protocol.Touch{Action: protocol.TouchUp})
+	select {
+	case touch := <-sent:
+		if touch.Action != protocol.TouchUp {
+			t.Fatalf("touch = %#v, want up", touch)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the pipeline stopped at the failed send")
+	}
+	if stats := p.Stats(); stats.Failed != 1 || stats.Sent != 1 {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+
+	close(stop)
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return on stop")
+	}
+}
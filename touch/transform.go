@@ -0,0 +1,80 @@
+package touch
+
+import "math"
+
+// Max is the dongle's touch coordinate range: 0..Max on both axes.
+const Max = 10000
+
+type Fit int
+
+const (
+	// Contain scales the frame to fit the view, leaving letterbox bars
+	// (the default for a <video> element).
+	Contain Fit = iota
+	// Fill stretches the frame to the view, ignoring its aspect ratio.
+	Fill
+	// Cover scales the frame to cover the view, cropping the overflow.
+	Cover
+)
+
+// Layout describes how a video frame is presented in the viewer.
+type Layout struct {
+	ViewWidth, ViewHeight   float64 // viewer size, in the unit of the touch coordinates
+	FrameWidth, FrameHeight float64 // size of the decoded frame
+	Fit                     Fit
+	Rotation                int // clockwise rotation of the shown frame: 0, 90, 180 or 270
+	MirrorX, MirrorY        bool
+}
+
+// Map converts a point in view coordinates to dongle touch coordinates.
+// The result is clamped to 0..Max; inside is false when the point lies
+// outside the picture, e.g. on a letterbox bar.
+func (l Layout) Map(x, y float64) (tx, ty uint32, inside bool) {
+	if l.ViewWidth <= 0 || l.ViewHeight <= 0 {
+		return 0, 0, false
+	}
+	frameWidth, frameHeight := l.FrameWidth, l.FrameHeight
+	if frameWidth <= 0 || frameHeight <= 0 {
+		frameWidth, frameHeight = l.ViewWidth, l.ViewHeight
+	}
+
+	rotation := ((l.Rotation % 360) + 360) % 360
+	shownWidth, shownHeight := frameWidth, frameHeight
+	if rotation == 90 || rotation == 270 {
+		shownWidth, shownHeight = frameHeight, frameWidth
+	}
+
+	scaleX, scaleY := l.ViewWidth/shownWidth, l.ViewHeight/shownHeight
+	switch l.Fit {
+	case Contain:
+		scaleX = math.Min(scaleX, scaleY)
+		scaleY = scaleX
+	case Cover:
+		scaleX = math.Max(scaleX, scaleY)
+		scaleY = scaleX
+	}
+	width, height := shownWidth*scaleX, shownHeight*scaleY
+	u := (x - (l.ViewWidth-width)/2) / width
+	v := (y - (l.ViewHeight-height)/2) / height
+	inside = u >= 0 && u <= 1 && v >= 0 && v <= 1
+
+	if l.MirrorX {
+		u = 1 - u
+	}
+	if l.MirrorY {
+		v = 1 - v
+	}
+	switch rotation {
+	case 90:
+		u, v = v, 1-u
+	case 180:
+		u, v = 1-u, 1-v
+	case 270:
+		u, v = 1-v, u
+	}
+	return scale(u), scale(v), inside
+}
+
+func scale(f float64) uint32 {
+	return uint32(math.Round(math.Max(0, math.Min(1, f)) * Max))
+}
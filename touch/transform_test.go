@@ -0,0 +1,37 @@
+package touch
+
+import "testing"
+
+func TestLayoutMap(t *testing.T) {
+	tests := []struct {
+		name   string
+		layout Layout
+		x, y   float64
+		tx, ty uint32
+		inside bool
+	}{
+		{"exact fit", Layout{ViewWidth: 960, ViewHeight: 360, FrameWidth: 960, FrameHeight: 360}, 480, 90, 5000, 2500, true},
+		{"no frame yet", Layout{ViewWidth: 960, ViewHeight: 360}, 960, 360, 10000, 10000, true},
+		{"pillarbox center", Layout{ViewWidth: 1000, ViewHeight: 500, FrameWidth: 800, FrameHeight: 800}, 500, 250, 5000, 5000, true},
+		{"pillarbox left edge", Layout{ViewWidth: 1000, ViewHeight: 500, FrameWidth: 800, FrameHeight: 800}, 250, 0, 0, 0, true},
+		{"pillarbox bar", Layout{ViewWidth: 1000, ViewHeight: 500, FrameWidth: 800, FrameHeight: 800}, 100, 250, 0, 5000, false},
+		{"letterbox bar", Layout{ViewWidth: 800, ViewHeight: 800, FrameWidth: 1600, FrameHeight: 900}, 400, 790, 5000, 10000, false},
+		{"letterbox inside", Layout{ViewWidth: 800, ViewHeight: 800, FrameWidth: 1600, FrameHeight: 900}, 200, 400, 2500, 5000, true},
+		{"fill", Layout{ViewWidth: 1000, ViewHeight: 500, FrameWidth: 800, FrameHeight: 800, Fit: Fill}, 250, 125, 2500, 2500, true},
+		{"cover", Layout{ViewWidth: 1000, ViewHeight: 500, FrameWidth: 800, FrameHeight: 800, Fit: Cover}, 0, 0, 0, 2500, true},
+		{"rotate 90", Layout{ViewWidth: 360, ViewHeight: 960, FrameWidth: 960, FrameHeight: 360, Rotation: 90}, 360, 0, 0, 0, true},
+		{"rotate 90 bottom left", Layout{ViewWidth: 360, ViewHeight: 960, FrameWidth: 960, FrameHeight: 360, Rotation: 90}, 0, 960, 10000, 10000, true},
+		{"rotate 180", Layout{ViewWidth: 960, ViewHeight: 360, FrameWidth: 960, FrameHeight: 360, Rotation: 180}, 240, 90, 7500, 7500, true},
+		{"rotate 270", Layout{ViewWidth: 360, ViewHeight: 960, FrameWidth: 960, FrameHeight: 360, Rotation: 270}, 0, 960, 0, 0, true},
+		{"rotate -90", Layout{ViewWidth: 360, ViewHeight: 960, FrameWidth: 960, FrameHeight: 360, Rotation: -90}, 0, 960, 0, 0, true},
+		{"mirror x", Layout{ViewWidth: 960, ViewHeight: 360, FrameWidth: 960, FrameHeight: 360, MirrorX: true}, 240, 90, 7500, 2500, true},
+		{"mirror y", Layout{ViewWidth: 960, ViewHeight: 360, FrameWidth: 960, FrameHeight: 360, MirrorY: true}, 240, 90, 2500, 7500, true},
+		{"clamped outside view", Layout{ViewWidth: 960, ViewHeight: 360, FrameWidth: 960, FrameHeight: 360}, -20, 400, 0, 10000, false},
+	}
+	for _, test := range tests {
+		tx, ty, inside := test.layout.Map(test.x, test.y)
+		if tx != test.tx || ty != test.ty || inside != test.inside {
+			t.Errorf("%s: Map(%v, %v) = %d, %d, %v; want %d, %d, %v", test.name, test.x, test.y, tx, ty, inside, test.tx, test.ty, test.inside)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+// turnRealm is the realm of the embedded TURN server.
+const turnRealm = "carplay"
+
+// embeddedTURN is the TURN server started for -turn. Its credentials are
+// derived from a secret made up at start, so they expire after -turn-ttl
+// and die with the process.
+var embeddedTURN struct {
+	server *turn.Server
+	secret string
+	addr   *net.UDPAddr
+}
+
+// startTURN starts the TURN server for viewers whose network lets no UDP
+// through between peers. It relays on -turn-ip, by default the first IPv4
+// address of this machine, and only to the peer connections of this host:
+// anyone asking /api/ice gets credentials, so the server must not open the
+// way into the LAN or to services on localhost.
+func startTURN() error {
+	relayIP := cfg.TURNIP
+	if relayIP == nil {
+		var err error
+		if relayIP, err = localIPv4(); err != nil {
+			return err
+		}
+	}
+	conn, err := net.ListenPacket("udp4", cfg.TURN)
+	if err != nil {
+		return err
+	}
+	peers, err := iceAddresses(relayIP)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	var secret [32]byte
+	rand.Read(secret[:])
+	embeddedTURN.secret = hex.EncodeToString(secret[:])
+	// viewers reach the server at the address it listens on, or else at
+	// the one it relays on; either is IPv4 like the server
+	embeddedTURN.addr = &net.UDPAddr{IP: relayIP, Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	if ip := conn.LocalAddr().(*net.UDPAddr).IP; !ip.IsUnspecified() {
+		embeddedTURN.addr.IP = ip
+	}
+
+	embeddedTURN.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       turnRealm,
+		AuthHandler: turn.NewLongTermAuthHandler(embeddedTURN.secret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			RelayAddressGenerator: &peerRelayGenerator{
+				RelayAddressGeneratorStatic: turn.RelayAddressGeneratorStatic{RelayAddress: relayIP, Address: "0.0.0.0"},
+				allowed:                     peers.allowed,
+			},
+		}},
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	log.Printf("TURN on UDP %s, relaying on %s\n", conn.LocalAddr(), relayIP)
+	return nil
+}
+
+func localIPv4() (net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.To4(), nil
+		}
+	}
+	return nil, errors.New("no IPv4 address to relay on, set -turn-ip")
+}
+
+// iceAddressSet are the addresses the peer connections of this host use:
+// its IPs other than loopback, with the -nat-ip ones, and the -udp-mux port
+// or -udp-ports range. Without either the peer connections may use any
+// port, checkICE refuses that with -turn.
+type iceAddressSet struct {
+	ips              []net.IP
+	portMin, portMax int
+}
+
+func iceAddresses(relayIP net.IP) (iceAddressSet, error) {
+	set := iceAddressSet{ips: []net.IP{relayIP}}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return set, err
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() {
+			set.ips = append(set.ips, ipNet.IP)
+		}
+	}
+	for _, ip := range cfg.NATIPs {
+		set.ips = append(set.ips, net.ParseIP(ip))
+	}
+	switch {
+	case cfg.UDPMux != "":
+		addr, err := net.ResolveUDPAddr("udp", cfg.UDPMux)
+		if err != nil {
+			return set, err
+		}
+		set.portMin, set.portMax = addr.Port, addr.Port
+	case cfg.UDPPortMin != 0:
+		set.portMin, set.portMax = int(cfg.UDPPortMin), int(cfg.UDPPortMax)
+	default:
+		return set, errors.New("-turn needs -udp-mux or -udp-ports")
+	}
+	return set, nil
+}
+
+func (set iceAddressSet) allowed(addr *net.UDPAddr) bool {
+	if addr.Port < set.portMin || addr.Port > set.portMax || addr.IP.IsLoopback() {
+		return false
+	}
+	for _, ip := range set.ips {
+		if ip.Equal(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerRelayGenerator allocates relay sockets that only exchange packets
+// with the allowed peers.
+type peerRelayGenerator struct {
+	turn.RelayAddressGeneratorStatic
+	allowed func(*net.UDPAddr) bool
+}
+
+func (g *peerRelayGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, addr, err := g.RelayAddressGeneratorStatic.AllocatePacketConn(network, requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &peerFilterConn{PacketConn: conn, allowed: g.allowed}, addr, nil
+}
+
+// peerFilterConn drops the packets to and from peers that are not allowed.
+type peerFilterConn struct {
+	net.PacketConn
+	allowed func(*net.UDPAddr) bool
+}
+
+func (c *peerFilterConn) permits(addr net.Addr) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	return ok && c.allowed(udp)
+}
+
+func (c *peerFilterConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.permits(addr) {
+			return n, addr, err
+		}
+	}
+}
+
+// WriteTo pretends to send to a peer that is not allowed, a relay error
+// for every packet would only fill the log.
+func (c *peerFilterConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.permits(addr) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// turnICEServer is the embedded TURN server with credentials valid for
+// -turn-ttl.
+func turnICEServer() (webrtc.ICEServer, bool) {
+	if embeddedTURN.server == nil {
+		return webrtc.ICEServer{}, false
+	}
+	username, password, err := turn.GenerateLongTermCredentials(embeddedTURN.secret, cfg.TURNTTL)
+	if err != nil {
+		log.Printf("[turn] %s\n", err)
+		return webrtc.ICEServer{}, false
+	}
+	url := "turn:" + embeddedTURN.addr.String() + "?transport=udp"
+	return webrtc.ICEServer{URLs: []string{url}, Username: username, Credential: password}, true
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestICEAddressSet(t *testing.T) {
+	set := iceAddressSet{ips: []net.IP{net.IPv4(192, 168, 1, 10), net.ParseIP("fe80::1")}, portMin: 8443, portMax: 8443}
+	tests := []struct {
+		addr    net.UDPAddr
+		allowed bool
+	}{
+		{net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 8443}, true},
+		{net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 8443}, true},
+		{net.UDPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 53}, false},
+		{net.UDPAddr{IP: net.IPv4(192, 168, 1, 1), Port: 8443}, false},
+		{net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8443}, false},
+	}
+	for _, test := range tests {
+		if allowed := set.allowed(&test.addr); allowed != test.allowed {
+			t.Errorf("%s allowed: %v, want %v", &test.addr, allowed, test.allowed)
+		}
+	}
+}
+
+func TestPeerFilterConn(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	relay, peer, other := listen(), listen(), listen()
+	filter := &peerFilterConn{PacketConn: relay, allowed: func(addr *net.UDPAddr) bool {
+		return addr.Port == peer.LocalAddr().(*net.UDPAddr).Port
+	}}
+
+	// sent to the other one, the packet is dropped
+	if n, err := filter.WriteTo([]byte("no"), other.LocalAddr()); n != 2 || err != nil {
+		t.Fatalf("WriteTo a refused peer: %d, %v", n, err)
+	}
+	filter.WriteTo([]byte("yes"), peer.LocalAddr())
+	buf := make([]byte, 16)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if n, _, err := peer.ReadFrom(buf); err != nil || string(buf[:n]) != "yes" {
+		t.Fatalf("the peer got %q, %v", buf[:n], err)
+	}
+	other.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, _, err := other.ReadFrom(buf); err == nil {
+		t.Fatalf("a refused peer got %q", buf[:n])
+	}
+
+	// packets of the other one are skipped
+	other.WriteTo([]byte("no"), relay.LocalAddr())
+	time.Sleep(10 * time.Millisecond)
+	peer.WriteTo([]byte("yes"), relay.LocalAddr())
+	filter.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := filter.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "yes" || addr.String() != peer.LocalAddr().String() {
+		t.Fatalf("read %q from %v, %v", buf[:n], addr, err)
+	}
+}
+
+func TestCheckICETURNPorts(t *testing.T) {
+	if err := checkICE(config{TURN: ":3478"}); err == nil {
+		t.Error("-turn accepted without a port range")
+	}
+	if err := checkICE(config{TURN: ":3478", UDPMux: ":8443"}); err != nil {
+		t.Errorf("-turn with -udp-mux: %v", err)
+	}
+	if err := checkICE(config{TURN: ":3478", UDPPortMin: 50000, UDPPortMax: 50100}); err != nil {
+		t.Errorf("-turn with -udp-ports: %v", err)
+	}
+}
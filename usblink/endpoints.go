@@ -0,0 +1,246 @@
+package usblink
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gousb"
+	"sort"
+)
+
+var (
+	dongleVendor   = gousb.ID(0x1314)
+	dongleProducts = []gousb.ID{0x1521, 0x1520}
+)
+
+func isDongle(desc *gousb.DeviceDesc) bool {
+	if desc.Vendor != dongleVendor {
+		return false
+	}
+	for _, product := range dongleProducts {
+		if desc.Product == product {
+			return true
+		}
+	}
+	return false
+}
+
+// Layout is where the dongle's bulk endpoints live.
+type Layout struct {
+	Config     int `json:"config"`
+	Interface  int `json:"interface"`
+	AltSetting int `json:"altSetting"`
+	In         int `json:"in"`
+	Out        int `json:"out"`
+	InMaxSize  int `json:"inMaxPacketSize"`
+	OutMaxSize int `json:"outMaxPacketSize"`
+}
+
+func (l Layout) String() string {
+	return fmt.Sprintf("config %d, interface %d.%d, in %d, out %d", l.Config, l.Interface, l.AltSetting, l.In, l.Out)
+}
+
+// FindLayout picks the interface setting with a bulk IN and OUT endpoint.
+// Vendor specific interfaces and the active configuration are preferred,
+// active is 0 when it is not known. Within a setting a pair with the same
+// endpoint number wins over the lowest numbers.
+func FindLayout(desc *gousb.DeviceDesc, active int) (Layout, error) {
+	var configs []int
+	for number := range desc.Configs {
+		configs = append(configs, number)
+	}
+	sort.Ints(configs)
+
+	var (
+		best      Layout
+		bestScore = -1
+	)
+	for _, number := range configs {
+		for _, intf := range desc.Configs[number].Interfaces {
+			for _, setting := range intf.AltSettings {
+				layout, ok := bulkPair(setting)
+				if !ok {
+					continue
+				}
+				layout.Config = number
+
+				score := 0
+				if setting.Class == gousb.ClassVendorSpec {
+					score += 2
+				}
+				if number == active {
+					score++
+				}
+				if score > bestScore {
+					best, bestScore = layout, score
+				}
+			}
+		}
+	}
+	if bestScore < 0 {
+		return Layout{}, errors.New("no interface with bulk in and out endpoints")
+	}
+	return best, nil
+}
+
+func bulkPair(setting gousb.InterfaceSetting) (Layout, bool) {
+	var ins, outs []gousb.EndpointDesc
+	for _, ep := range setting.Endpoints {
+		if ep.TransferType != gousb.TransferTypeBulk {
+			continue
+		}
+		if ep.Direction == gousb.EndpointDirectionIn {
+			ins = append(ins, ep)
+		} else {
+			outs = append(outs, ep)
+		}
+	}
+	if len(ins) == 0 || len(outs) == 0 {
+		return Layout{}, false
+	}
+	byNumber := func(eps []gousb.EndpointDesc) {
+		sort.Slice(eps, func(i, j int) bool { return eps[i].Number < eps[j].Number })
+	}
+	byNumber(ins)
+	byNumber(outs)
+
+	in, out := ins[0], outs[0]
+pair:
+	for _, i := range ins {
+		for _, o := range outs {
+			if i.Number == o.Number {
+				in, out = i, o
+				break pair
+			}
+		}
+	}
+	return Layout{
+		Interface:  setting.Number,
+		AltSetting: setting.Alternate,
+		In:         in.Number,
+		Out:        out.Number,
+		InMaxSize:  in.MaxPacketSize,
+		OutMaxSize: out.MaxPacketSize,
+	}, true
+}
+
+// openLayout claims the interface of layout and opens its endpoints, done
+// releases them.
+func openLayout(product *gousb.Device, layout Layout) (*gousb.InEndpoint, *gousb.OutEndpoint, func(), error) {
+	cfg, err := product.Config(layout.Config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	intf, err := cfg.Interface(layout.Interface, layout.AltSetting)
+	if err != nil {
+		cfg.Close()
+		return nil, nil, nil, err
+	}
+	done := func() {
+		intf.Close()
+		cfg.Close()
+	}
+	epIn, err := intf.InEndpoint(layout.In)
+	if err != nil {
+		done()
+		return nil, nil, nil, err
+	}
+	epOut, err := intf.OutEndpoint(layout.Out)
+	if err != nil {
+		done()
+		return nil, nil, nil, err
+	}
+	return epIn, epOut, done, nil
+}
+
+// Setting describes one interface setting of a probed device.
+type Setting struct {
+	Config    int        `json:"config"`
+	Interface int        `json:"interface"`
+	Alternate int        `json:"alternate"`
+	Class     string     `json:"class"`
+	Endpoints []Endpoint `json:"endpoints"`
+}
+
+// Endpoint describes one endpoint of a probed interface setting.
+type Endpoint struct {
+	Address       string `json:"address"`
+	Number        int    `json:"number"`
+	Direction     string `json:"direction"`
+	TransferType  string `json:"transferType"`
+	MaxPacketSize int    `json:"maxPacketSize"`
+}
+
+// DeviceInfo describes an attached dongle and the layout the link would use.
+type DeviceInfo struct {
+	Bus      int       `json:"bus"`
+	Address  int       `json:"address"`
+	Path     string    `json:"path"`
+	Serial   string    `json:"serial,omitempty"`
+	Vendor   string    `json:"vendor"`
+	Product  string    `json:"product"`
+	Speed    string    `json:"speed"`
+	Settings []Setting `json:"settings"`
+	Layout   *Layout   `json:"layout,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func describe(desc *gousb.DeviceDesc) DeviceInfo {
+	info := DeviceInfo{
+		Bus:     desc.Bus,
+		Address: desc.Address,
+		Path:    devicePath(desc),
+		Vendor:  desc.Vendor.String(),
+		Product: desc.Product.String(),
+		Speed:   desc.Speed.String(),
+	}
+	var configs []int
+	for number := range desc.Configs {
+		configs = append(configs, number)
+	}
+	sort.Ints(configs)
+	for _, number := range configs {
+		for _, intf := range desc.Configs[number].Interfaces {
+			for _, alt := range intf.AltSettings {
+				setting := Setting{Config: number, Interface: alt.Number, Alternate: alt.Alternate, Class: alt.Class.String()}
+				for _, ep := range alt.Endpoints {
+					setting.Endpoints = append(setting.Endpoints, Endpoint{
+						Address:       fmt.Sprintf("0x%02x", uint8(ep.Address)),
+						Number:        ep.Number,
+						Direction:     ep.Direction.String(),
+						TransferType:  ep.TransferType.String(),
+						MaxPacketSize: ep.MaxPacketSize,
+					})
+				}
+				sort.Slice(setting.Endpoints, func(i, j int) bool {
+					return setting.Endpoints[i].Address < setting.Endpoints[j].Address
+				})
+				info.Settings = append(info.Settings, setting)
+			}
+		}
+	}
+	if layout, err := FindLayout(desc, 0); err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Layout = &layout
+	}
+	return info
+}
+
+// Probe lists the attached dongles. They are only opened to read their
+// serial numbers, which works while a link is using them.
+func Probe() ([]DeviceInfo, error) {
+	ctx := gousb.NewContext()
+	defer ctx.Close()
+
+	devs, err := ctx.OpenDevices(isDongle)
+	var devices []DeviceInfo
+	for _, dev := range devs {
+		info := describe(dev.Desc)
+		if serial, err := dev.SerialNumber(); err == nil {
+			info.Serial = serial
+		}
+		dev.Close()
+		devices = append(devices, info)
+	}
+	return devices, err
+}
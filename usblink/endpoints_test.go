@@ -0,0 +1,72 @@
+package usblink
+
+import (
+	"github.com/google/gousb"
+	"testing"
+)
+
+func bulk(number int, dir gousb.EndpointDirection) gousb.EndpointDesc {
+	addr := gousb.EndpointAddress(number)
+	if dir == gousb.EndpointDirectionIn {
+		addr |= 0x80
+	}
+	return gousb.EndpointDesc{Address: addr, Number: number, Direction: dir, TransferType: gousb.TransferTypeBulk, MaxPacketSize: 512}
+}
+
+func setting(intf int, class gousb.Class, eps ...gousb.EndpointDesc) gousb.InterfaceDesc {
+	endpoints := make(map[gousb.EndpointAddress]gousb.EndpointDesc)
+	for _, ep := range eps {
+		endpoints[ep.Address] = ep
+	}
+	return gousb.InterfaceDesc{
+		Number:      intf,
+		AltSettings: []gousb.InterfaceSetting{{Number: intf, Class: class, Endpoints: endpoints}},
+	}
+}
+
+func TestFindLayout(t *testing.T) {
+	in, out := gousb.EndpointDirectionIn, gousb.EndpointDirectionOut
+	tests := []struct {
+		name string
+		desc gousb.DeviceDesc
+		want Layout
+	}{
+		{
+			name: "classic dongle",
+			desc: gousb.DeviceDesc{Configs: map[int]gousb.ConfigDesc{1: {Number: 1, Interfaces: []gousb.InterfaceDesc{
+				setting(0, gousb.ClassVendorSpec, bulk(1, in), bulk(1, out)),
+			}}}},
+			want: Layout{Config: 1, Interface: 0, In: 1, Out: 1, InMaxSize: 512, OutMaxSize: 512},
+		},
+		{
+			name: "different endpoint numbers",
+			desc: gousb.DeviceDesc{Configs: map[int]gousb.ConfigDesc{1: {Number: 1, Interfaces: []gousb.InterfaceDesc{
+				setting(0, gousb.ClassVendorSpec, bulk(3, in), bulk(2, out), bulk(2, in)),
+			}}}},
+			want: Layout{Config: 1, Interface: 0, In: 2, Out: 2, InMaxSize: 512, OutMaxSize: 512},
+		},
+		{
+			name: "vendor interface after a mass storage one",
+			desc: gousb.DeviceDesc{Configs: map[int]gousb.ConfigDesc{1: {Number: 1, Interfaces: []gousb.InterfaceDesc{
+				setting(0, gousb.ClassMassStorage, bulk(1, in), bulk(1, out)),
+				setting(1, gousb.ClassVendorSpec, bulk(4, in), bulk(5, out)),
+			}}}},
+			want: Layout{Config: 1, Interface: 1, In: 4, Out: 5, InMaxSize: 512, OutMaxSize: 512},
+		},
+	}
+	for _, tt := range tests {
+		got, err := FindLayout(&tt.desc, 1)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if got != tt.want {
+			t.Errorf("%s: FindLayout = %+v; want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	desc := gousb.DeviceDesc{Configs: map[int]gousb.ConfigDesc{1: {Number: 1, Interfaces: []gousb.InterfaceDesc{
+		setting(0, gousb.ClassVendorSpec, bulk(1, in)),
+	}}}}
+	if _, err := FindLayout(&desc, 1); err == nil {
+		t.Error("FindLayout accepted an interface without an out endpoint")
+	}
+}
@@ -0,0 +1,172 @@
+package usblink
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"webrtc/protocol"
+)
+
+// Priority classes of outgoing messages. Lower values are written first.
+type Priority int
+
+const (
+	PriorityInput Priority = iota
+	PriorityControl
+	PriorityHeartbeat
+	PriorityBulk
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"input", "control", "heartbeat", "bulk"}
+
+func (p Priority) String() string {
+	if p >= 0 && p < numPriorities {
+		return priorityNames[p]
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// DefaultBatchWindow bounds how long a message of each class may wait for
+// others to share its USB transfer.
+var DefaultBatchWindow = map[Priority]time.Duration{
+	PriorityInput:     0,
+	PriorityControl:   20 * time.Millisecond,
+	PriorityHeartbeat: 100 * time.Millisecond,
+	PriorityBulk:      300 * time.Millisecond,
+}
+
+// ParseBatchWindow parses "class=duration" pairs separated by commas, e.g.
+// "input=0,bulk=100ms".
+func ParseBatchWindow(s string) (map[Priority]time.Duration, error) {
+	windows := make(map[Priority]time.Duration)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("batch window %q: want class=duration", pair)
+		}
+		prio := Priority(-1)
+		for p, name := range priorityNames {
+			if name == kv[0] {
+				prio = Priority(p)
+			}
+		}
+		if prio < 0 {
+			return nil, fmt.Errorf("batch window %q: unknown class %q", pair, kv[0])
+		}
+		window, err := time.ParseDuration(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("batch window %q: %s", pair, err)
+		}
+		windows[prio] = window
+	}
+	return windows, nil
+}
+
+// bulkFileSize is the size from which a file written to the dongle is bulk.
+// Smaller files are settings and keep their place among the control
+// messages: the init handshake relies on its order, /tmp/screen_dpi has to
+// come before Open.
+const bulkFileSize = 4 << 10
+
+func priorityOf(msg interface{}) Priority {
+	if wait, ok := msg.(*waitMessage); ok {
+		msg = wait.msg
+	}
+	switch msg := msg.(type) {
+	case *protocol.Touch, *protocol.MultiTouch:
+		return PriorityInput
+	case *protocol.CarPlay:
+		if msg.Type.IsButton() {
+			return PriorityInput
+		}
+	case *protocol.Heartbeat:
+		return PriorityHeartbeat
+	case *protocol.SendFile:
+		if len(msg.Content) >= bulkFileSize {
+			return PriorityBulk
+		}
+	}
+	return PriorityControl
+}
+
+// queueCapacity is the number of messages each class may hold.
+const queueCapacity = 1024
+
+var (
+	ErrQueueFull = errors.New("usblink: send queue full")
+	ErrStopped   = errors.New("usblink: not running")
+)
+
+type outItem struct {
+	msg    interface{}
+	queued time.Time
+}
+
+// outQueue holds the messages waiting for the OUT endpoint, one FIFO per
+// priority class.
+type outQueue struct {
+	mu      sync.Mutex
+	classes [numPriorities][]outItem
+	notify  chan struct{}
+	space   chan struct{}
+}
+
+func newOutQueue() *outQueue {
+	return &outQueue{notify: make(chan struct{}, 1)}
+}
+
+// push queues msg. If its class is full it returns a channel that is closed
+// once a message has been taken out.
+func (q *outQueue) push(msg interface{}) (bool, <-chan struct{}) {
+	prio := priorityOf(msg)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.classes[prio]) >= queueCapacity {
+		if q.space == nil {
+			q.space = make(chan struct{})
+		}
+		return false, q.space
+	}
+	q.classes[prio] = append(q.classes[prio], outItem{msg: msg, queued: time.Now()})
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// pop takes the oldest message of the most important non-empty class.
+func (q *outQueue) pop() (outItem, Priority, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for prio := range q.classes {
+		if len(q.classes[prio]) == 0 {
+			continue
+		}
+		item := q.classes[prio][0]
+		q.classes[prio][0] = outItem{}
+		q.classes[prio] = q.classes[prio][1:]
+		if q.space != nil {
+			close(q.space)
+			q.space = nil
+		}
+		return item, Priority(prio), true
+	}
+	return outItem{}, 0, false
+}
+
+func (q *outQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, class := range q.classes {
+		n += len(class)
+	}
+	return n
+}
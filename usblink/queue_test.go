@@ -0,0 +1,113 @@
+package usblink
+
+import (
+	"github.com/google/gousb"
+	"testing"
+	"time"
+	"webrtc/protocol"
+)
+
+func TestOutQueuePriority(t *testing.T) {
+	q := newOutQueue()
+	q.push(&protocol.SendFile{FileName: "/tmp/gocarplay_probe\x00", Content: make([]byte, bulkFileSize)})
+	q.push(&protocol.Heartbeat{})
+	q.push(&protocol.Open{})
+	q.push(&protocol.Touch{Action: protocol.TouchDown})
+
+	want := []Priority{PriorityInput, PriorityControl, PriorityHeartbeat, PriorityBulk}
+	for _, w := range want {
+		_, prio, ok := q.pop()
+		if !ok || prio != w {
+			t.Fatalf("pop = %s, %v; want %s", prio, ok, w)
+		}
+	}
+	if _, _, ok := q.pop(); ok {
+		t.Fatal("queue not empty")
+	}
+}
+
+func TestOutQueueInitOrder(t *testing.T) {
+	q := newOutQueue()
+	init := []interface{}{
+		&protocol.SendFile{FileName: "/tmp/screen_dpi\x00", Content: []byte{160, 0, 0, 0}},
+		&protocol.Open{Width: 800, Height: 480},
+		&protocol.ManufacturerInfo{},
+		&protocol.SendFile{FileName: "/tmp/night_mode\x00", Content: []byte{1, 0, 0, 0}},
+		&protocol.SendFile{FileName: "/etc/android_work_mode\x00", Content: []byte{0, 0, 0, 0}},
+		&protocol.BoxSettings{},
+		&protocol.CarPlay{Type: protocol.SupportWifi},
+		&protocol.CarPlay{Type: protocol.Wifi5G},
+		&protocol.CarPlay{Type: protocol.WifiConnect},
+	}
+	for _, msg := range init {
+		q.push(msg)
+	}
+	// a button pressed meanwhile still goes first
+	button := &protocol.CarPlay{Type: protocol.BtnHome}
+	q.push(button)
+
+	want := append([]interface{}{button}, init...)
+	for i, w := range want {
+		item, _, ok := q.pop()
+		if !ok || item.msg != w {
+			t.Fatalf("pop %d = %#v, want %#v", i, item.msg, w)
+		}
+	}
+}
+
+func TestOutQueueFull(t *testing.T) {
+	q := newOutQueue()
+	for i := 0; i < queueCapacity; i++ {
+		if ok, _ := q.push(&protocol.Heartbeat{}); !ok {
+			t.Fatalf("push %d failed", i)
+		}
+	}
+	ok, space := q.push(&protocol.Heartbeat{})
+	if ok || space == nil {
+		t.Fatal("push into a full class succeeded")
+	}
+	if ok, _ := q.push(&protocol.Touch{}); !ok {
+		t.Fatal("a full class blocked another class")
+	}
+	q.pop()
+	select {
+	case <-space:
+	default:
+		t.Fatal("pop did not signal free space")
+	}
+}
+
+func TestParseBatchWindow(t *testing.T) {
+	windows, err := ParseBatchWindow("input=0, bulk=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(windows) != 2 || windows[PriorityInput] != 0 || windows[PriorityBulk] != 100*time.Millisecond {
+		t.Fatalf("unexpected windows %v", windows)
+	}
+	if _, err = ParseBatchWindow("video=1ms"); err == nil {
+		t.Fatal("unknown class accepted")
+	}
+}
+
+func TestSendAfterStop(t *testing.T) {
+	l := &USBLink{usbCtx: gousb.NewContext()}
+	l.exitChan = make(chan struct{})
+	l.recovery = make(chan Recovery, 1)
+	l.outData = newOutQueue()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for l.SendMessage(&protocol.Heartbeat{}) != ErrStopped {
+		}
+	}()
+	l.Stop()
+	<-done
+	if err := l.SendMessageWait(&protocol.Heartbeat{}); err != ErrStopped {
+		t.Fatalf("SendMessageWait after Stop: %v", err)
+	}
+	if err := l.Recover(RecoverReinit); err != ErrStopped {
+		t.Fatalf("Recover after Stop: %v", err)
+	}
+}
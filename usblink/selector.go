@@ -0,0 +1,83 @@
+package usblink
+
+import (
+	"fmt"
+	"github.com/google/gousb"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Selector picks one dongle when several are attached. The zero value takes
+// any dongle that no other link of this process is using.
+type Selector struct {
+	// Path is the bus and port chain, e.g. "1-2.4" as in /sys/bus/usb/devices.
+	Path string
+	// Serial is the serial number string of the device.
+	Serial string
+}
+
+// ParseSelector parses "path:1-2.4", "serial:ABC123" or a bare path. An
+// empty string or "any" selects any dongle.
+func ParseSelector(s string) (Selector, error) {
+	switch {
+	case s == "", s == "any":
+		return Selector{}, nil
+	case strings.HasPrefix(s, "serial:"):
+		return Selector{Serial: strings.TrimPrefix(s, "serial:")}, nil
+	}
+	path := strings.TrimPrefix(s, "path:")
+	bus := strings.SplitN(path, "-", 2)
+	if _, err := strconv.Atoi(bus[0]); err != nil || len(bus) != 2 {
+		return Selector{}, fmt.Errorf("invalid dongle selector %q, want path:<bus>-<port>[.<port>...] or serial:<serial>", s)
+	}
+	for _, port := range strings.Split(bus[1], ".") {
+		if _, err := strconv.Atoi(port); err != nil {
+			return Selector{}, fmt.Errorf("invalid port in dongle selector %q", s)
+		}
+	}
+	return Selector{Path: path}, nil
+}
+
+func (s Selector) String() string {
+	switch {
+	case s.Path != "":
+		return "path:" + s.Path
+	case s.Serial != "":
+		return "serial:" + s.Serial
+	}
+	return "any"
+}
+
+func (s Selector) matchesDesc(desc *gousb.DeviceDesc) bool {
+	return s.Path == "" || s.Path == devicePath(desc)
+}
+
+// devicePath formats the port chain of a device like the kernel does.
+func devicePath(desc *gousb.DeviceDesc) string {
+	if len(desc.Path) == 0 {
+		return fmt.Sprintf("%d-%d", desc.Bus, desc.Port)
+	}
+	ports := make([]string, len(desc.Path))
+	for i, port := range desc.Path {
+		ports[i] = strconv.Itoa(port)
+	}
+	return fmt.Sprintf("%d-%s", desc.Bus, strings.Join(ports, "."))
+}
+
+// claimed are the devices opened by the links of this process, so links
+// without a selector do not fight over the same dongle.
+var claimed = struct {
+	sync.Mutex
+	devices map[string]bool
+}{devices: make(map[string]bool)}
+
+func deviceKey(desc *gousb.DeviceDesc) string {
+	return fmt.Sprintf("%d:%d", desc.Bus, desc.Address)
+}
+
+func releaseDevice(desc *gousb.DeviceDesc) {
+	claimed.Lock()
+	defer claimed.Unlock()
+	delete(claimed.devices, deviceKey(desc))
+}
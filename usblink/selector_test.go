@@ -0,0 +1,42 @@
+package usblink
+
+import (
+	"github.com/google/gousb"
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Selector
+	}{
+		{"", Selector{}},
+		{"path:1-2.4", Selector{Path: "1-2.4"}},
+		{"3-1", Selector{Path: "3-1"}},
+		{"serial:ABC123", Selector{Serial: "ABC123"}},
+	}
+	for _, tt := range tests {
+		got, err := ParseSelector(tt.in)
+		if err != nil || got != tt.want {
+			t.Errorf("ParseSelector(%q) = %+v, %v; want %+v", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"path:1", "x-1", "1-2.a"} {
+		if _, err := ParseSelector(in); err == nil {
+			t.Errorf("ParseSelector(%q) succeeded", in)
+		}
+	}
+}
+
+func TestSelectorMatchesDesc(t *testing.T) {
+	desc := &gousb.DeviceDesc{Bus: 1, Address: 7, Port: 4, Path: []int{2, 4}}
+	if path := devicePath(desc); path != "1-2.4" {
+		t.Fatalf("devicePath = %q; want 1-2.4", path)
+	}
+	if !(Selector{}).matchesDesc(desc) || !(Selector{Path: "1-2.4"}).matchesDesc(desc) {
+		t.Error("selector does not match its device")
+	}
+	if (Selector{Path: "1-2"}).matchesDesc(desc) {
+		t.Error("selector matches the hub port")
+	}
+}
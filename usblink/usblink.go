@@ -2,15 +2,35 @@ package usblink
 
 import (
 	"bufio"
+	"context"
 	"github.com/google/gousb"
+	"io"
 	"log"
+	"sync"
 	"time"
 	"webrtc/protocol"
 )
 
 type USBLink struct {
+	// BatchWindow overrides DefaultBatchWindow for some priority classes.
+	BatchWindow map[Priority]time.Duration
+	// Device selects the dongle when several are attached.
+	Device Selector
+	// Watchdog decides when the link counts as stalled and how to recover.
+	Watchdog WatchdogConfig
+	// OnIncident, if set, is called for every link health incident.
+	OnIncident func(Incident)
+	// Tap, if set, sees every message as it is written to (incoming false)
+	// or read from the dongle, header included.
+	Tap func(incoming bool, data []byte)
+
+	// runMu guards exitChan, recovery and outData against Start and Stop,
+	// the link's own goroutines read them while it runs.
+	runMu       sync.Mutex
 	exitChan    chan struct{}
-	outData     chan interface{}
+	recovery    chan Recovery
+	health      health
+	outData     *outQueue
 	waitGroup   WaitGroupWrapper
 	usbCtx      *gousb.Context
 	onVideo     func(protocol.VideoData)
@@ -21,8 +41,18 @@ type USBLink struct {
 }
 
 func (l *USBLink) loop() {
+	for first := true; l.session(first); first = false {
+	}
+}
+
+// session opens the dongle and serves it until the link is stopped or has
+// to be opened again. It reports whether to search for the dongle again.
+func (l *USBLink) session(first bool) bool {
 	//stage 1: detect and connect
-	timeAfter := 0 * time.Second //first time immediately
+	timeAfter := 2 * time.Second
+	if first {
+		timeAfter = 0 //first time immediately
+	}
 	var (
 		product *gousb.Device
 		err     error
@@ -32,7 +62,7 @@ func (l *USBLink) loop() {
 		case <-time.After(timeAfter):
 			timeAfter = 2 * time.Second
 		case <-l.exitChan:
-			return
+			return false
 		}
 		product, err = l.usbConnect()
 		if err != nil {
@@ -44,34 +74,75 @@ func (l *USBLink) loop() {
 		}
 	}
 	defer product.Close()
+	defer releaseDevice(product.Desc)
 
-	intf, done, err := product.DefaultInterface()
-	if err != nil {
-		log.Fatal(err)
+	recovery, again := l.serve(product)
+	if recovery == RecoverReset {
+		if err := product.Reset(); err != nil {
+			log.Printf("cannot reset product: %s\n", err)
+		}
 	}
-	defer done()
+	return again
+}
 
-	//TODO: найти in/out в устройстве
-	epOut, err := intf.OutEndpoint(1)
+// serve runs the endpoint processes until the link is stopped or a recovery
+// other than a re-init is requested, and returns that recovery.
+func (l *USBLink) serve(product *gousb.Device) (Recovery, bool) {
+	active, err := product.ActiveConfigNum()
 	if err != nil {
-		log.Fatal(err)
+		active = 0
 	}
-	epIn, err := intf.InEndpoint(1)
+	layout, err := FindLayout(product.Desc, active)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("cannot use product: %s\n", err)
+		return RecoverReconnect, true
+	}
+	log.Printf("using %s\n", layout)
+	epIn, epOut, done, err := openLayout(product, layout)
+	if err != nil {
+		log.Printf("cannot open endpoints: %s\n", err)
+		return RecoverReconnect, true
+	}
+	defer done()
+
+	// forget requests left over from the previous session
+	select {
+	case <-l.recovery:
+	default:
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	l.health.connect(time.Now(), devicePath(product.Desc), layout)
+	defer l.health.disconnect()
+
 	var endpointWg WaitGroupWrapper
+	defer endpointWg.Wait()
+	defer cancel()
+	endpointWg.Wrap(func() {
+		l.outEndpointProcess(ctx, epOut)
+	})
 	endpointWg.Wrap(func() {
-		l.outEndpointProcess(epOut)
+		l.inEndpointProcess(ctx, epIn)
 	})
 	endpointWg.Wrap(func() {
-		l.inEndpointProcess(epIn)
+		l.watchdog(ctx)
 	})
-	endpointWg.Wait()
+
+	for {
+		select {
+		case recovery := <-l.recovery:
+			if recovery != RecoverReinit {
+				return recovery, true
+			}
+			l.health.reinit(time.Now())
+			l.onReadySend()
+		case <-l.exitChan:
+			return RecoverNone, false
+		}
+	}
 }
 
-func (l *USBLink) outEndpointProcess(out *gousb.OutEndpoint) {
+func (l *USBLink) outEndpointProcess(ctx context.Context, out *gousb.OutEndpoint) {
 
 	/*
 		stream, err := out.NewStream(512*9600, 1)
@@ -84,100 +155,178 @@ func (l *USBLink) outEndpointProcess(out *gousb.OutEndpoint) {
 	l.onReadySend()
 
 	buff := make([]byte, 0, 512*9600)
+	var (
+		written []chan error
+		err     error
+	)
+
+	heartbeat := time.NewTicker(2 * time.Second)
+	defer heartbeat.Stop()
 
-	timeAfter := 2 * time.Second
 	for {
 		select {
-		case <-time.After(timeAfter):
-			//log.Println("herbeat")
-			l.sendUsbMessage(out, &protocol.Heartbeat{})
-		case msg := <-l.outData:
-			start := time.Now()
-			remaining := cap(buff)
-			bMsg, err := protocol.Marshal(msg)
-			if err != nil {
-				log.Fatal(err)
-			}
-			if remaining > len(bMsg) {
-				remaining -= len(bMsg)
-				buff = append(buff, bMsg...)
-			} else {
-				_, err = out.Write(bMsg)
-				if err != nil {
-					log.Fatal(err)
-				}
-				continue
+		case <-ctx.Done():
+			return
+		case <-heartbeat.C:
+			l.outData.push(&protocol.Heartbeat{})
+		default:
+		}
+
+		item, prio, ok := l.outData.pop()
+		if !ok {
+			select {
+			case <-l.outData.notify:
+			case <-heartbeat.C:
+				//log.Println("herbeat")
+				l.outData.push(&protocol.Heartbeat{})
+			case <-ctx.Done():
+				return
 			}
+			continue
+		}
 
-		loop:
-			for {
-				if time.Now().Sub(start) > 300*time.Millisecond {
-					_, err = out.Write(buff)
-					if err != nil {
-						log.Fatal(err)
-					}
-					break loop
+		// collect whatever else is queued into one transfer, but keep no
+		// message longer than its class allows
+		deadline := item.queued.Add(l.batchWindow(prio))
+		for ok {
+			bMsg, done := marshalOut(item.msg)
+			if l.Tap != nil {
+				l.Tap(false, bMsg)
+			}
+			if len(buff)+len(bMsg) > cap(buff) && len(buff) > 0 {
+				if written, err = l.writeOut(ctx, out, buff, written); err != nil {
+					return
 				}
-				select {
-				case msg = <-l.outData:
-					bMsg, err = protocol.Marshal(msg)
-					if err != nil {
-						log.Fatal(err)
-					}
-					if remaining > len(bMsg) {
-						remaining -= len(bMsg)
-						buff = append(buff, bMsg...)
-					} else {
-						_, err = out.Write(buff)
-						if err != nil {
-							log.Fatal(err)
-						}
-
-						_, err = out.Write(bMsg)
-						if err != nil {
-							log.Fatal(err)
-						}
-						break loop
-					}
-				default:
-					_, err = out.Write(buff)
-					if err != nil {
-						log.Fatal(err)
-					}
-					break loop
+				buff = buff[:0]
+			}
+			if len(bMsg) > cap(buff) {
+				if written, err = l.writeOut(ctx, out, bMsg, appendDone(written, done)); err != nil {
+					return
 				}
+			} else {
+				buff = append(buff, bMsg...)
+				written = appendDone(written, done)
+			}
+			if d := item.queued.Add(l.batchWindow(prio)); d.Before(deadline) {
+				deadline = d
+			}
+			item, prio, ok = l.nextForBatch(ctx, deadline)
+		}
+		if len(buff) > 0 {
+			if written, err = l.writeOut(ctx, out, buff, written); err != nil {
+				return
 			}
-
 			buff = buff[:0]
-		case <-l.exitChan:
-			return
 		}
 	}
 }
 
-func (l *USBLink) inEndpointProcess(in *gousb.InEndpoint) {
+func (l *USBLink) batchWindow(prio Priority) time.Duration {
+	if window, ok := l.BatchWindow[prio]; ok {
+		return window
+	}
+	return DefaultBatchWindow[prio]
+}
+
+// nextForBatch waits until deadline for another message to add to the
+// current transfer.
+func (l *USBLink) nextForBatch(ctx context.Context, deadline time.Time) (outItem, Priority, bool) {
+	for {
+		if item, prio, ok := l.outData.pop(); ok {
+			return item, prio, true
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return outItem{}, 0, false
+		}
+		select {
+		case <-l.outData.notify:
+		case <-time.After(wait):
+			return outItem{}, 0, false
+		case <-ctx.Done():
+			return outItem{}, 0, false
+		}
+	}
+}
+
+// waitMessage is queued by SendMessageWait, done receives the result of
+// writing the message to the dongle.
+type waitMessage struct {
+	msg  interface{}
+	done chan error
+}
+
+func marshalOut(msg interface{}) ([]byte, chan error) {
+	var done chan error
+	if wait, ok := msg.(*waitMessage); ok {
+		msg, done = wait.msg, wait.done
+	}
+	bMsg, err := protocol.Marshal(msg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return bMsg, done
+}
+
+func appendDone(written []chan error, done chan error) []chan error {
+	if done != nil {
+		written = append(written, done)
+	}
+	return written
+}
+
+// writeOut writes data and releases the SendMessageWait callers whose
+// messages it carried. A failed write is reported as an incident.
+func (l *USBLink) writeOut(ctx context.Context, out *gousb.OutEndpoint, data []byte, written []chan error) ([]chan error, error) {
+	_, err := out.WriteContext(ctx, data)
+	if err != nil {
+		if ctx.Err() == nil {
+			l.incident(IncidentWriteError, err.Error(), l.Watchdog.Recovery.atLeast(RecoverReconnect))
+		}
+	}
+	for _, done := range written {
+		done <- err
+	}
+	return written[:0], err
+}
+
+func (l *USBLink) inEndpointProcess(ctx context.Context, in *gousb.InEndpoint) {
 	//ctx := context.Background()
 
 	stream, err := in.NewStream(512*9600, 180)
 	if err != nil {
-		log.Fatal(err)
+		l.incident(IncidentReadError, err.Error(), l.Watchdog.Recovery.atLeast(RecoverReconnect))
+		return
 	}
 	defer stream.Close()
 
-	br := bufio.NewReaderSize(stream, 512*9600)
+	br := bufio.NewReaderSize(streamReader{ctx: ctx, stream: stream}, 512*9600)
 
 	//incoming := make(chan incomingPacket, 10000)
 	//go l.incoming(incoming)
 
 	for {
 		select {
-		case <-l.exitChan:
+		case <-ctx.Done():
 			return
 		default:
-			packet, err := l.receiveVideoAudioUsbMessage(br)
-			if err != nil && l.onError != nil {
-				l.onError(err)
-			} else if packet.buf != nil && l.onData != nil {
+			packet, err := l.receiveUsbMessage(br)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if l.onError != nil {
+					l.onError(err)
+				}
+				// the stream is broken or out of sync, reading on would only repeat the error
+				l.incident(IncidentReadError, err.Error(), l.Watchdog.Recovery.atLeast(RecoverReconnect))
+				return
+			}
+			l.health.received(packet.header.Type, 16+len(packet.buf), time.Now())
+			if l.Tap != nil {
+				l.Tap(true, append(packet.raw, packet.buf...))
+			}
+			if packet.buf != nil && l.onData != nil {
 				switch packet.header.Type {
 				case protocol.VideoDataPacketType:
 					video, err := protocol.UnmarhalVideoData(packet.buf)
@@ -193,23 +342,22 @@ func (l *USBLink) inEndpointProcess(in *gousb.InEndpoint) {
 					} else {
 						l.onAudio(audio)
 					}
+				case protocol.NaviVideoDataPacketType:
+					video, err := protocol.UnmarhalVideoData(packet.buf)
+					if err != nil && l.onError != nil {
+						l.onError(err)
+					} else {
+						navi := protocol.NaviVideoData(video)
+						l.onData(&navi)
+					}
 				default:
-					/*
-						payload := protocol.GetPayloadByHeader(packet.data.header)
-						err := protocol.Unmarshal(packet.data.buf, payload)
-						if err != nil && l.onError != nil {
-							l.onError(err)
-						} else {
-							switch data := payload.(type) {
-							case *protocol.VideoData:
-								incomingVideo <- *data
-							case *protocol.AudioData:
-								incomingAudio <- *data
-							default:
-								incomingData <- data
-							}
-						}
-					*/
+					payload := protocol.GetPayloadByHeader(packet.header)
+					err := protocol.Unmarshal(packet.buf, payload)
+					if err != nil {
+						log.Printf("cannot decode packet type 0x%x: %s\n", packet.header.Type, err)
+					} else {
+						l.onData(payload)
+					}
 				}
 			}
 
@@ -335,42 +483,41 @@ func (l *USBLink) incomingData(in chan interface{}) {
 
 type usbMessage struct {
 	header protocol.Header
+	raw    []byte // header bytes
 	buf    []byte
 }
 
-func (l *USBLink) receiveVideoAudioUsbMessage(reader *bufio.Reader) (usbMessage, error) {
-	for {
-		msg, err := l.receiveUsbMessage(reader)
-		if err != nil {
-			return msg, err
-		}
-		if msg.header.Type == protocol.VideoDataPacketType || msg.header.Type == protocol.AudioDataPacketType {
-			return msg, nil
-		}
-	}
-}
-
 func (l *USBLink) receiveUsbMessage(reader *bufio.Reader) (usbMessage, error) {
 	buf := make([]byte, 16)
 
-	num, err := reader.Read(buf)
-	if err != nil || num != len(buf) {
+	// a message may span several USB transfers
+	if _, err := io.ReadFull(reader, buf); err != nil {
 		return usbMessage{}, err
 	}
-	hdr, err := protocol.UnmarshalHeader(buf[:num])
+	hdr, err := protocol.UnmarshalHeader(buf)
 	if err != nil {
 		return usbMessage{}, err
 	}
 
-	buf = make([]byte, hdr.Length)
+	payload := make([]byte, hdr.Length)
 	if hdr.Length > 0 {
-		num, err = reader.Read(buf)
-		if err != nil || num != len(buf) {
+		if _, err = io.ReadFull(reader, payload); err != nil {
 			return usbMessage{}, err
 		}
 	}
 
-	return usbMessage{header: hdr, buf: buf}, nil
+	return usbMessage{header: hdr, raw: buf, buf: payload}, nil
+}
+
+// streamReader reads from a stream until ctx is done, so a session can end
+// while a read is waiting for the dongle.
+type streamReader struct {
+	ctx    context.Context
+	stream *gousb.ReadStream
+}
+
+func (r streamReader) Read(p []byte) (int, error) {
+	return r.stream.ReadContext(r.ctx, p)
 }
 
 func (l *USBLink) sendUsbMessage(out *gousb.OutEndpoint, msg interface{}) error {
@@ -397,11 +544,13 @@ func (l *USBLink) sendUsbMessage(out *gousb.OutEndpoint, msg interface{}) error
 }
 
 func (l *USBLink) usbConnect() (*gousb.Device, error) {
-	vid, pid, pid2 := gousb.ID(0x1314), gousb.ID(0x1521), gousb.ID(0x1520)
+	claimed.Lock()
+	defer claimed.Unlock()
+
 	devs, err := l.usbCtx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
-		founded := desc.Vendor == vid && (desc.Product == pid || desc.Product == pid2)
+		founded := isDongle(desc) && !claimed.devices[deviceKey(desc)] && l.Device.matchesDesc(desc)
 		if founded {
-			log.Printf("product found: %s", desc, desc.Speed)
+			log.Printf("product found: %s, path: %s, speed: %s", desc, devicePath(desc), desc.Speed)
 			for _, cfgDesc := range desc.Configs {
 				for _, intDesc := range cfgDesc.Interfaces {
 					for _, altSetting := range intDesc.AltSettings {
@@ -417,27 +566,120 @@ func (l *USBLink) usbConnect() (*gousb.Device, error) {
 	if err != nil {
 		return nil, err
 	}
-	if len(devs) > 0 {
-		var device *gousb.Device
-		for i, dev := range devs {
-			if i == 0 {
-				device = dev
-			} else {
-				dev.Close()
-			}
+	var device *gousb.Device
+	for _, dev := range devs {
+		if device == nil && l.matchesSerial(dev) {
+			device = dev
+		} else {
+			dev.Close()
+		}
+	}
+	if device != nil {
+		claimed.devices[deviceKey(device.Desc)] = true
+	}
+	return device, nil
+}
+
+func (l *USBLink) matchesSerial(dev *gousb.Device) bool {
+	if l.Device.Serial == "" {
+		return true
+	}
+	serial, err := dev.SerialNumber()
+	return err == nil && serial == l.Device.Serial
+}
+
+// SendMessage queues msg for the dongle without blocking. It fails with
+// ErrQueueFull when the message's priority class has no room left.
+func (l *USBLink) SendMessage(msg interface{}) error {
+	queue, _, _ := l.running()
+	if queue == nil {
+		return ErrStopped
+	}
+	if ok, _ := queue.push(msg); !ok {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// Send queues msg for the dongle, waiting for room in its priority class
+// until ctx is done.
+func (l *USBLink) Send(ctx context.Context, msg interface{}) error {
+	queue, exit, _ := l.running()
+	if queue == nil {
+		return ErrStopped
+	}
+	for {
+		ok, space := queue.push(msg)
+		if ok {
+			return nil
 		}
-		return device, nil
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-exit:
+			return ErrStopped
+		}
+	}
+}
+
+// SendMessageWait queues msg like Send and waits until it has been written
+// to the dongle.
+func (l *USBLink) SendMessageWait(msg interface{}) error {
+	_, exit, _ := l.running()
+	wait := &waitMessage{msg: msg, done: make(chan error, 1)}
+	if err := l.Send(context.Background(), wait); err != nil {
+		return err
+	}
+	select {
+	case err := <-wait.done:
+		return err
+	case <-exit:
+		return ErrStopped
+	}
+}
+
+// QueueLen returns the number of messages waiting to be written.
+func (l *USBLink) QueueLen() int {
+	if queue, _, _ := l.running(); queue != nil {
+		return queue.len()
 	}
-	return nil, nil
+	return 0
 }
 
-func (l *USBLink) SendMessage(msg interface{}) {
-	//if l.outData != nil {
-	l.outData <- msg
-	//}
+// Health returns a snapshot of the link state.
+func (l *USBLink) Health() Health {
+	return l.health.snapshot()
+}
+
+// Recover runs a recovery by hand, it is reported like a watchdog incident.
+func (l *USBLink) Recover(r Recovery) error {
+	if _, _, recovery := l.running(); recovery == nil {
+		return ErrStopped
+	}
+	l.incident(IncidentManual, "requested by hand", r)
+	return nil
+}
+
+// running returns the send queue, exit and recovery channels of the running
+// link, all nil once Stop has begun.
+func (l *USBLink) running() (*outQueue, chan struct{}, chan Recovery) {
+	l.runMu.Lock()
+	defer l.runMu.Unlock()
+	if l.exitChan == nil {
+		return nil, nil, nil
+	}
+	select {
+	case <-l.exitChan:
+		return nil, nil, nil
+	default:
+	}
+	return l.outData, l.exitChan, l.recovery
 }
 
 func (l *USBLink) Start(onReadySend func(), onVideo func(protocol.VideoData), onAudio func(protocol.AudioData), onData func(interface{}), onError func(error)) error {
+	l.runMu.Lock()
+	defer l.runMu.Unlock()
 	if l.exitChan != nil {
 		return nil
 	}
@@ -450,21 +692,33 @@ func (l *USBLink) Start(onReadySend func(), onVideo func(protocol.VideoData), on
 
 	l.usbCtx = gousb.NewContext()
 	l.exitChan = make(chan struct{})
-	l.outData = make(chan interface{}, 1024)
+	l.recovery = make(chan Recovery, 1)
+	l.outData = newOutQueue()
 	l.waitGroup.Wrap(l.loop)
 	log.Println("USBLink started")
 	return nil
 }
 
 func (l *USBLink) Stop() {
+	l.runMu.Lock()
 	if l.exitChan == nil {
+		l.runMu.Unlock()
+		return
+	}
+	select {
+	case <-l.exitChan:
+		// another Stop is under way
+		l.runMu.Unlock()
 		return
+	default:
 	}
 	close(l.exitChan)
+	l.runMu.Unlock()
 	l.waitGroup.Wait()
+	l.runMu.Lock()
 	l.exitChan = nil
-	close(l.outData)
 	l.outData = nil
+	l.runMu.Unlock()
 
 	l.onData = nil
 	l.onError = nil
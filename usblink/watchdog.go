@@ -0,0 +1,341 @@
+package usblink
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+	"webrtc/protocol"
+)
+
+// Class groups incoming packets for link health tracking.
+type Class int
+
+const (
+	ClassVideo Class = iota
+	ClassAudio
+	ClassNavi
+	ClassControl
+	numClasses
+)
+
+func (c Class) String() string {
+	switch c {
+	case ClassVideo:
+		return "video"
+	case ClassAudio:
+		return "audio"
+	case ClassNavi:
+		return "navi"
+	case ClassControl:
+		return "control"
+	}
+	return fmt.Sprintf("class(%d)", int(c))
+}
+
+func classOf(packetType uint32) Class {
+	switch packetType {
+	case protocol.VideoDataPacketType:
+		return ClassVideo
+	case protocol.AudioDataPacketType:
+		return ClassAudio
+	case protocol.NaviVideoDataPacketType:
+		return ClassNavi
+	}
+	return ClassControl
+}
+
+// Recovery is what the watchdog does about an unhealthy link, ordered from
+// the mildest to the most drastic.
+type Recovery int
+
+const (
+	// RecoverNone only reports the incident.
+	RecoverNone Recovery = iota
+	// RecoverReinit repeats the init handshake on the open link.
+	RecoverReinit
+	// RecoverReconnect closes the dongle and opens it again.
+	RecoverReconnect
+	// RecoverReset resets the USB device before opening it again.
+	RecoverReset
+)
+
+func (r Recovery) String() string {
+	switch r {
+	case RecoverNone:
+		return "none"
+	case RecoverReinit:
+		return "reinit"
+	case RecoverReconnect:
+		return "reconnect"
+	case RecoverReset:
+		return "reset"
+	}
+	return fmt.Sprintf("recovery(%d)", int(r))
+}
+
+func (r Recovery) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// atLeast escalates r to min. RecoverNone is escalated too: it only turns
+// off the recovery from stalls, a link that failed a transfer is dead.
+func (r Recovery) atLeast(min Recovery) Recovery {
+	if r >= min {
+		return r
+	}
+	return min
+}
+
+// ParseRecovery parses the names printed by Recovery.String.
+func ParseRecovery(s string) (Recovery, error) {
+	for r := RecoverNone; r <= RecoverReset; r++ {
+		if strings.EqualFold(s, r.String()) {
+			return r, nil
+		}
+	}
+	return RecoverNone, fmt.Errorf("unknown recovery %q", s)
+}
+
+// WatchdogConfig tells the watchdog when the link counts as stalled and how
+// to recover. Recoveries that do not help are escalated with every further
+// incident, up to RecoverReset.
+type WatchdogConfig struct {
+	// VideoTimeout is how long video may be missing while a phone is
+	// plugged, zero disables the check.
+	VideoTimeout time.Duration
+	// LinkTimeout is how long the dongle may send nothing at all, zero
+	// disables the check.
+	LinkTimeout time.Duration
+	Recovery    Recovery
+}
+
+var DefaultWatchdog = WatchdogConfig{
+	VideoTimeout: 5 * time.Second,
+	Recovery:     RecoverReinit,
+}
+
+const (
+	IncidentVideoStall = "video-stall"
+	IncidentLinkSilent = "link-silent"
+	IncidentReadError  = "read-error"
+	IncidentWriteError = "write-error"
+	IncidentManual     = "manual"
+)
+
+// Incident describes a link health problem and what was done about it.
+type Incident struct {
+	Kind     string    `json:"kind"`
+	Detail   string    `json:"detail,omitempty"`
+	Recovery Recovery  `json:"recovery"`
+	Time     time.Time `json:"time"`
+}
+
+// Health is a snapshot of the link state.
+type Health struct {
+	Connected    bool                 `json:"connected"`
+	Since        *time.Time           `json:"since,omitempty"`
+	Device       string               `json:"device,omitempty"`
+	PhonePlugged bool                 `json:"phonePlugged"`
+	LastReceived map[string]time.Time `json:"lastReceived"`
+	BytesIn      map[string]int64     `json:"bytesIn"`
+	Layout       *Layout              `json:"layout,omitempty"`
+	Incidents    int                  `json:"incidents"`
+	LastIncident *Incident            `json:"lastIncident,omitempty"`
+}
+
+type health struct {
+	mu        sync.Mutex
+	connected bool
+	since     time.Time
+	device    string
+	layout    Layout
+	plugged   bool
+	pluggedAt time.Time
+	last      [numClasses]time.Time
+	bytes     [numClasses]int64
+	// checkpoint restarts the timeouts after an incident or a recovery
+	checkpoint   time.Time
+	strikes      int
+	incidents    int
+	lastIncident *Incident
+}
+
+func (h *health) connect(now time.Time, device string, layout Layout) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = true
+	h.since = now
+	h.device = device
+	h.layout = layout
+	h.plugged = false
+	h.last = [numClasses]time.Time{}
+	h.bytes = [numClasses]int64{}
+	h.checkpoint = now
+}
+
+func (h *health) disconnect() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connected = false
+	h.plugged = false
+}
+
+func (h *health) reinit(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.checkpoint = now
+}
+
+func (h *health) received(packetType uint32, size int, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	class := classOf(packetType)
+	h.last[class] = now
+	h.bytes[class] += int64(size)
+	switch packetType {
+	case protocol.PluggedPacketType:
+		h.plugged = true
+		h.pluggedAt = now
+	case protocol.UnpluggedPacketType:
+		h.plugged = false
+	}
+	if class == ClassVideo || !h.plugged {
+		h.strikes = 0
+	}
+}
+
+// check returns the kind of incident the link is in at now, if any, and how
+// many incidents in a row the link has had without recovering.
+func (h *health) check(cfg WatchdogConfig, now time.Time) (string, string, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.connected {
+		return "", "", 0
+	}
+	if cfg.LinkTimeout > 0 {
+		last := h.checkpoint
+		for _, t := range h.last {
+			if t.After(last) {
+				last = t
+			}
+		}
+		if silent := now.Sub(last); silent > cfg.LinkTimeout {
+			h.checkpoint = now
+			h.strikes++
+			return IncidentLinkSilent, fmt.Sprintf("nothing received for %s", silent.Round(time.Second)), h.strikes
+		}
+	}
+	if cfg.VideoTimeout > 0 && h.plugged {
+		last := h.checkpoint
+		for _, t := range []time.Time{h.pluggedAt, h.last[ClassVideo]} {
+			if t.After(last) {
+				last = t
+			}
+		}
+		if stalled := now.Sub(last); stalled > cfg.VideoTimeout {
+			h.checkpoint = now
+			h.strikes++
+			return IncidentVideoStall, fmt.Sprintf("no video for %s while a phone is plugged", stalled.Round(time.Second)), h.strikes
+		}
+	}
+	return "", "", 0
+}
+
+func (h *health) record(incident Incident) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.incidents++
+	h.lastIncident = &incident
+}
+
+func (h *health) snapshot() Health {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	snapshot := Health{
+		Connected:    h.connected,
+		PhonePlugged: h.plugged,
+		LastReceived: make(map[string]time.Time),
+		BytesIn:      make(map[string]int64),
+		Incidents:    h.incidents,
+	}
+	if h.connected {
+		since, layout := h.since, h.layout
+		snapshot.Since = &since
+		snapshot.Layout = &layout
+		snapshot.Device = h.device
+	}
+	for class, t := range h.last {
+		if !t.IsZero() {
+			snapshot.LastReceived[Class(class).String()] = t
+			snapshot.BytesIn[Class(class).String()] = h.bytes[class]
+		}
+	}
+	if h.lastIncident != nil {
+		incident := *h.lastIncident
+		snapshot.LastIncident = &incident
+	}
+	return snapshot
+}
+
+// escalate picks the recovery for the given number of incidents in a row.
+func escalate(base Recovery, strikes int) Recovery {
+	if base == RecoverNone || strikes <= 1 {
+		return base
+	}
+	r := base + Recovery(strikes-1)
+	if r > RecoverReset {
+		r = RecoverReset
+	}
+	return r
+}
+
+// watchdog reports an incident whenever the link stalls, until ctx is done.
+func (l *USBLink) watchdog(ctx context.Context) {
+	cfg := l.Watchdog
+	if cfg.VideoTimeout <= 0 && cfg.LinkTimeout <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if kind, detail, strikes := l.health.check(cfg, now); kind != "" {
+				l.incident(kind, detail, escalate(cfg.Recovery, strikes))
+			}
+		}
+	}
+}
+
+// incident reports a health problem and requests the recovery for it.
+func (l *USBLink) incident(kind, detail string, recovery Recovery) {
+	incident := Incident{Kind: kind, Detail: detail, Recovery: recovery, Time: time.Now()}
+	log.Printf("link incident %s: %s, recovery: %s\n", kind, detail, recovery)
+	l.health.record(incident)
+	if l.OnIncident != nil {
+		l.OnIncident(incident)
+	}
+	l.requestRecovery(recovery)
+}
+
+func (l *USBLink) requestRecovery(r Recovery) {
+	if r == RecoverNone {
+		return
+	}
+	for {
+		select {
+		case l.recovery <- r:
+			return
+		case pending := <-l.recovery:
+			// keep the more drastic of the two
+			if pending > r {
+				r = pending
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package usblink
+
+import (
+	"testing"
+	"time"
+	"webrtc/protocol"
+)
+
+func TestHealthVideoStall(t *testing.T) {
+	cfg := WatchdogConfig{VideoTimeout: 5 * time.Second, Recovery: RecoverReinit}
+	start := time.Unix(1000, 0)
+	var h health
+	h.connect(start, "", Layout{})
+
+	if kind, _, _ := h.check(cfg, start.Add(time.Minute)); kind != "" {
+		t.Fatalf("stall reported without a phone: %s", kind)
+	}
+
+	h.received(protocol.PluggedPacketType, 16, start.Add(time.Minute))
+	h.received(protocol.VideoDataPacketType, 16, start.Add(time.Minute+time.Second))
+	if kind, _, _ := h.check(cfg, start.Add(time.Minute+5*time.Second)); kind != "" {
+		t.Fatalf("stall reported while video flows: %s", kind)
+	}
+
+	for i := 1; i <= 3; i++ {
+		now := start.Add(time.Minute + time.Second + time.Duration(i)*6*time.Second)
+		kind, _, strikes := h.check(cfg, now)
+		if kind != IncidentVideoStall || strikes != i {
+			t.Fatalf("check %d = %q, %d; want %q, %d", i, kind, strikes, IncidentVideoStall, i)
+		}
+	}
+
+	h.received(protocol.VideoDataPacketType, 16, start.Add(2*time.Minute))
+	if h.strikes != 0 {
+		t.Fatalf("strikes = %d after video; want 0", h.strikes)
+	}
+}
+
+func TestHealthLinkSilent(t *testing.T) {
+	cfg := WatchdogConfig{LinkTimeout: 10 * time.Second}
+	start := time.Unix(1000, 0)
+	var h health
+	h.connect(start, "", Layout{})
+
+	h.received(protocol.HeartbeatPacketType, 16, start.Add(5*time.Second))
+	if kind, _, _ := h.check(cfg, start.Add(12*time.Second)); kind != "" {
+		t.Fatalf("check = %q; want no incident", kind)
+	}
+	if kind, _, _ := h.check(cfg, start.Add(16*time.Second)); kind != IncidentLinkSilent {
+		t.Fatalf("check = %q; want %q", kind, IncidentLinkSilent)
+	}
+
+	h.disconnect()
+	if kind, _, _ := h.check(cfg, start.Add(time.Hour)); kind != "" {
+		t.Fatalf("check = %q while disconnected", kind)
+	}
+}
+
+func TestEscalate(t *testing.T) {
+	tests := []struct {
+		base    Recovery
+		strikes int
+		want    Recovery
+	}{
+		{RecoverNone, 5, RecoverNone},
+		{RecoverReinit, 1, RecoverReinit},
+		{RecoverReinit, 2, RecoverReconnect},
+		{RecoverReinit, 3, RecoverReset},
+		{RecoverReinit, 10, RecoverReset},
+		{RecoverReset, 1, RecoverReset},
+	}
+	for _, tt := range tests {
+		if got := escalate(tt.base, tt.strikes); got != tt.want {
+			t.Errorf("escalate(%s, %d) = %s; want %s", tt.base, tt.strikes, got, tt.want)
+		}
+	}
+}
+
+func TestAtLeast(t *testing.T) {
+	for r, want := range map[Recovery]Recovery{
+		RecoverNone:      RecoverReconnect,
+		RecoverReinit:    RecoverReconnect,
+		RecoverReconnect: RecoverReconnect,
+		RecoverReset:     RecoverReset,
+	} {
+		if got := r.atLeast(RecoverReconnect); got != want {
+			t.Errorf("%s.atLeast(reconnect) = %s; want %s", r, got, want)
+		}
+	}
+}
+
+func TestParseRecovery(t *testing.T) {
+	for r := RecoverNone; r <= RecoverReset; r++ {
+		got, err := ParseRecovery(r.String())
+		if err != nil || got != r {
+			t.Errorf("ParseRecovery(%q) = %s, %v", r.String(), got, err)
+		}
+	}
+	if _, err := ParseRecovery("reboot"); err == nil {
+		t.Error("ParseRecovery accepted an unknown name")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// whepHeaders lets players on other origins use the WHEP endpoints.
+func whepHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", "*")
+	h.Set("Access-Control-Allow-Methods", "POST, PATCH, DELETE, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Content-Type, If-Match, Authorization")
+	h.Set("Access-Control-Expose-Headers", "Location, Link, ETag, Accept-Patch")
+}
+
+// hasContentType reports whether r carries a body of media type typ.
+func hasContentType(r *http.Request, typ string) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == typ
+}
+
+// whepHandler is the WHEP endpoint: a player POSTs its SDP offer and gets the
+// answer, with the candidates gathered, and the URL of its session resource
+// in Location. ?stream=navi selects the instrument cluster stream. The
+// dongle starts if no viewer started it.
+func (s *session) whepHandler(w http.ResponseWriter, r *http.Request) {
+	whepHeaders(w)
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Accept-Post", "application/sdp")
+		iceLinks(w)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use POST"))
+		return
+	}
+	if !hasContentType(r, "application/sdp") {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("the offer must be application/sdp"))
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	pc, err := s.answerWHEP(r, string(offer), r.URL.Query().Get("stream"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	id := newResourceID()
+	s.whepMu.Lock()
+	if s.whep == nil {
+		s.whep = make(map[string]*webrtc.PeerConnection)
+	}
+	s.whep[id] = pc
+	s.whepMu.Unlock()
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			// the player shows nothing before a keyframe
+			s.requestKeyFrame()
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			s.dropWHEP(id)
+		}
+	})
+	s.startHeadless()
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", s.prefix+"/whep/"+id)
+	w.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
+	iceLinks(w)
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, pc.LocalDescription().SDP)
+}
+
+// answerWHEP creates the peer connection sending the video of stream to a
+// WHEP player and answers its offer once the candidates are gathered.
+func (s *session) answerWHEP(r *http.Request, offer, stream string) (*webrtc.PeerConnection, error) {
+	pc, err := newPeerConnection()
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*webrtc.PeerConnection, error) {
+		pc.Close()
+		return nil, err
+	}
+	track, err := s.track(stream)
+	if err != nil {
+		return fail(err)
+	}
+	if _, err = pc.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		return fail(err)
+	}
+	s.acceptDataChannels(pc)
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return fail(err)
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fail(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fail(err)
+	}
+	select {
+	case <-gathered:
+	case <-r.Context().Done():
+		return fail(r.Context().Err())
+	}
+	return pc, nil
+}
+
+func newResourceID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// dropWHEP forgets the resource id and closes its peer connection.
+func (s *session) dropWHEP(id string) {
+	s.whepMu.Lock()
+	pc := s.whep[id]
+	delete(s.whep, id)
+	s.whepMu.Unlock()
+	if pc != nil {
+		log.Printf("[whep] %s: session %s ended\n", s.name, id)
+		go pc.Close()
+	}
+}
+
+// whepResourceHandler serves the session resources of the WHEP players:
+// PATCH trickles the player's ICE candidates, DELETE ends the session.
+func (s *session) whepResourceHandler(w http.ResponseWriter, r *http.Request) {
+	whepHeaders(w)
+	id := strings.TrimPrefix(r.URL.Path, "/whep/")
+	s.whepMu.Lock()
+	pc := s.whep[id]
+	s.whepMu.Unlock()
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if pc == nil {
+		writeError(w, http.StatusNotFound, errors.New("no such WHEP session"))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		if !hasContentType(r, "application/trickle-ice-sdpfrag") {
+			writeError(w, http.StatusUnsupportedMediaType, errors.New("candidates must be application/trickle-ice-sdpfrag"))
+			return
+		}
+		if err := trickleSDPFrag(pc, io.LimitReader(r.Body, 1<<20)); err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		s.dropWHEP(id)
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use PATCH or DELETE"))
+	}
+}
+
+// trickleSDPFrag adds the candidates of an SDP fragment (RFC 8840). A
+// fragment with other ICE credentials than the offer asks for an ICE
+// restart, which a WHEP session does not support; the player starts a new
+// session instead.
+func trickleSDPFrag(pc *webrtc.PeerConnection, frag io.Reader) error {
+	candidates, err := parseSDPFrag(frag, sdpAttribute(pc.RemoteDescription().SDP, "ice-ufrag"))
+	if err != nil {
+		return err
+	}
+	for _, candidate := range candidates {
+		if err := pc.AddICECandidate(candidate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSDPFrag reads the candidates of an SDP fragment, each one tied to
+// the a=mid of its media section or else to the index of the m= line. It
+// fails for a fragment restarting ICE, one with another ufrag than ufrag.
+func parseSDPFrag(frag io.Reader, ufrag string) ([]webrtc.ICECandidateInit, error) {
+	var candidates []webrtc.ICECandidateInit
+	mline, mid := -1, ""
+	lines := bufio.NewScanner(frag)
+	for lines.Scan() {
+		line := strings.TrimSpace(lines.Text())
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			if other := strings.TrimPrefix(line, "a=ice-ufrag:"); other != ufrag {
+				return nil, fmt.Errorf("ICE restart to ufrag %q is not supported", other)
+			}
+		case strings.HasPrefix(line, "m="):
+			mline, mid = mline+1, ""
+		case strings.HasPrefix(line, "a=mid:"):
+			mid = strings.TrimPrefix(line, "a=mid:")
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidate := webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a=")}
+			if mid != "" {
+				value := mid
+				candidate.SDPMid = &value
+			} else if mline >= 0 {
+				index := uint16(mline)
+				candidate.SDPMLineIndex = &index
+			}
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates, lines.Err()
+}
+
+// sdpAttribute is the value of the first a=<name>: line of an SDP.
+func sdpAttribute(sdp, name string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if value := strings.TrimPrefix(strings.TrimSpace(line), "a="+name+":"); value != strings.TrimSpace(line) {
+			return value
+		}
+	}
+	return ""
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"webrtc/usblink"
+
+	"github.com/pion/ice/v2"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+)
+
+func TestSDPAttribute(t *testing.T) {
+	sdp := "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=ice-ufrag:abcd\r\na=ice-pwd:secret\r\na=ice-ufrag:later\r\n"
+	for name, want := range map[string]string{"ice-ufrag": "abcd", "ice-pwd": "secret", "mid": ""} {
+		if got := sdpAttribute(sdp, name); got != want {
+			t.Errorf("sdpAttribute(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestParseSDPFrag(t *testing.T) {
+	const candidate = "a=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host"
+	tests := []struct {
+		name  string
+		frag  string
+		mids  []string
+		lines []int
+		err   bool
+	}{
+		{
+			name: "mid",
+			frag: "a=ice-ufrag:abcd\r\na=ice-pwd:secret\r\nm=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n" + candidate + "\r\na=end-of-candidates\r\n",
+			mids: []string{"0"},
+		},
+		{
+			name:  "m-line index without mid",
+			frag:  "a=ice-ufrag:abcd\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\nm=video 9 UDP/TLS/RTP/SAVPF 0\r\n" + candidate + "\r\n",
+			lines: []int{1},
+		},
+		{
+			name: "mid of each section",
+			frag: "m=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:v\r\n" + candidate + "\r\nm=application 9 UDP/DTLS/SCTP webrtc-datachannel\r\na=mid:d\r\n" + candidate + "\r\n",
+			mids: []string{"v", "d"},
+		},
+		{
+			name: "no media section",
+			frag: candidate + "\n",
+			mids: []string{""},
+		},
+		{
+			name: "ICE restart",
+			frag: "a=ice-ufrag:efgh\r\na=ice-pwd:other\r\nm=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n" + candidate + "\r\n",
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			candidates, err := parseSDPFrag(strings.NewReader(test.frag), "abcd")
+			if test.err {
+				if err == nil {
+					t.Fatal("accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(test.mids) + len(test.lines); len(candidates) != want {
+				t.Fatalf("%d candidates, want %d", len(candidates), want)
+			}
+			for i, c := range candidates {
+				if c.Candidate != strings.TrimPrefix(candidate, "a=") {
+					t.Errorf("candidate %d is %q", i, c.Candidate)
+				}
+				switch {
+				case test.lines != nil:
+					if c.SDPMid != nil || c.SDPMLineIndex == nil || int(*c.SDPMLineIndex) != test.lines[i] {
+						t.Errorf("candidate %d: mid %v, m-line %v, want m-line %d", i, c.SDPMid, c.SDPMLineIndex, test.lines[i])
+					}
+				case test.mids[i] == "":
+					if c.SDPMid != nil || c.SDPMLineIndex != nil {
+						t.Errorf("candidate %d tied to a media section", i)
+					}
+				default:
+					if c.SDPMid == nil || *c.SDPMid != test.mids[i] || c.SDPMLineIndex != nil {
+						t.Errorf("candidate %d: mid %v, want %q", i, c.SDPMid, test.mids[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+// startSTUN answers STUN binding requests on the loopback interface, for
+// peer connections to gather against without network access.
+func startSTUN(t *testing.T) string {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := turn.NewServer(turn.ServerConfig{
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn:            conn,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{RelayAddress: net.IPv4(127, 0, 0, 1), Address: "127.0.0.1"},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	return "stun:" + conn.LocalAddr().String()
+}
+
+// whepOffer is the offer of a player receiving video, with its candidates.
+func whepOffer(t *testing.T) (*webrtc.PeerConnection, string) {
+	player, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { player.Close() })
+	if _, err := player.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := player.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(player)
+	if err := player.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return player, player.LocalDescription().SDP
+}
+
+func TestWHEP(t *testing.T) {
+	cfg.MDNS = ice.MulticastDNSModeDisabled
+	server, err := parseICEServer(startSTUN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ICEServers = []webrtc.ICEServer{server}
+	defer func() { cfg.ICEServers = nil }()
+
+	s := newSession("test", usblink.Selector{})
+	link := &sentLink{}
+	s.newLink = func() dongleLink { return link }
+	_, offer := whepOffer(t)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/whep", strings.NewReader(offer))
+	req.Header.Set("Content-Type", "application/sdp")
+	s.whepHandler(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("POST: %d %s", rec.Code, rec.Body)
+	}
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, s.prefix+"/whep/") || len(location) == len(s.prefix+"/whep/") {
+		t.Fatalf("Location %q", location)
+	}
+	if links := rec.Header().Values("Link"); len(links) != 1 || links[0] != "<"+server.URLs[0]+">; rel=\"ice-server\"" {
+		t.Fatalf("Link %q", links)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/sdp" || !strings.Contains(rec.Body.String(), "a=candidate:") {
+		t.Fatalf("answer of type %q without candidates:\n%s", ct, rec.Body)
+	}
+	if s.link() == nil {
+		t.Fatal("the dongle did not start")
+	}
+
+	patch := func(frag string) int {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPatch, strings.TrimPrefix(location, s.prefix), strings.NewReader(frag))
+		req.Header.Set("Content-Type", "application/trickle-ice-sdpfrag")
+		s.whepResourceHandler(rec, req)
+		return rec.Code
+	}
+	ufrag := sdpAttribute(offer, "ice-ufrag")
+	trickle := "a=ice-ufrag:" + ufrag + "\r\nm=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\na=candidate:1 1 udp 2130706431 192.0.2.1 50000 typ host\r\n"
+	if code := patch(trickle); code != http.StatusNoContent {
+		t.Fatalf("PATCH with a candidate: %d", code)
+	}
+	restart := "a=ice-ufrag:restart\r\na=ice-pwd:restartrestartrestartrestart\r\nm=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n"
+	if code := patch(restart); code != http.StatusUnprocessableEntity {
+		t.Fatalf("PATCH restarting ICE: %d", code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.whepResourceHandler(rec, httptest.NewRequest(http.MethodDelete, strings.TrimPrefix(location, s.prefix), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("DELETE: %d", rec.Code)
+	}
+	if code := patch(trickle); code != http.StatusNotFound {
+		t.Fatalf("PATCH after DELETE: %d", code)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+	"webrtc/protocol"
+)
+
+type wifiStatus struct {
+	Enabled   bool   `json:"enabled"`
+	Name      string `json:"name,omitempty"`
+	Band      string `json:"band,omitempty"`
+	Channel   int    `json:"channel,omitempty"`
+	Connected bool   `json:"connected"`
+}
+
+func wifiBandCommand(band string) (protocol.CarPlayType, error) {
+	switch band {
+	case "2.4g":
+		return protocol.Wifi24G, nil
+	case "5g":
+		return protocol.Wifi5G, nil
+	}
+	return protocol.Invalid, errors.New("wifi band must be 2.4g or 5g")
+}
+
+// enableWifi switches the dongle into wireless mode: it starts advertising
+// its access point and, once told to connect, accepts wireless CarPlay.
+func (s *session) enableWifi(band string) error {
+	cmd, err := wifiBandCommand(band)
+	if err != nil {
+		return err
+	}
+	link := s.link()
+	if err := link.SendMessage(&protocol.CarPlay{Type: protocol.SupportWifi}); err != nil {
+		return err
+	}
+	if err := link.SendMessage(&protocol.CarPlay{Type: cmd}); err != nil {
+		return err
+	}
+	time.AfterFunc(time.Second, func() {
+		link.SendMessage(&protocol.CarPlay{Type: protocol.WifiConnect})
+	})
+	s.status.updateWifi(func(wifi *wifiStatus) {
+		wifi.Enabled = true
+		wifi.Band = band
+	})
+	return nil
+}
+
+func (s *statusState) updateWifi(fn func(*wifiStatus)) {
+	var wifi wifiStatus
+	s.update(func(st *dongleStatus) {
+		fn(&st.Wifi)
+		wifi = st.Wifi
+	})
+	s.events.publish("wifi", wifi)
+}
+
+func (s *statusState) onWifiData(data interface{}) {
+	switch data := data.(type) {
+	case *protocol.WifiDeviceName:
+		s.updateWifi(func(wifi *wifiStatus) {
+			wifi.Name = trimNull(data.Data)
+		})
+	case *protocol.CarPlay:
+		switch data.Type {
+		case protocol.WifiConnected:
+			s.updateWifi(func(wifi *wifiStatus) {
+				wifi.Connected = true
+			})
+		case protocol.WifiDisconnected:
+			s.updateWifi(func(wifi *wifiStatus) {
+				wifi.Connected = false
+			})
+		}
+	}
+}
+
+// wifiHandler reports the wireless state (GET) or changes it (PUT). Only the
+// fields present in the request are applied.
+func (s *session) wifiHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, s.status.get().Wifi)
+		return
+	case http.MethodPut, http.MethodPost:
+	default:
+		writeError(w, http.StatusMethodNotAllowed, errors.New("use GET or PUT"))
+		return
+	}
+
+	var req struct {
+		Enabled *bool   `json:"enabled"`
+		Name    *string `json:"name"`
+		Band    *string `json:"band"`
+		Channel *int    `json:"channel"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Enabled != nil && !*req.Enabled {
+		writeError(w, http.StatusBadRequest, errors.New("wireless mode cannot be disabled without restarting the dongle"))
+		return
+	}
+	if req.Band != nil {
+		if _, err := wifiBandCommand(*req.Band); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	link := s.link()
+	if link == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("dongle is not started"))
+		return
+	}
+
+	if req.Name != nil || req.Channel != nil {
+		config := protocol.BoxConfig{SyncTime: time.Now().Unix()}
+		if req.Name != nil {
+			config.WifiName = *req.Name
+		}
+		if req.Channel != nil {
+			config.WifiChannel = *req.Channel
+		}
+		settings, err := protocol.NewBoxSettings(config)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := link.SendMessage(settings); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		s.status.updateWifi(func(wifi *wifiStatus) {
+			if req.Name != nil {
+				wifi.Name = *req.Name
+			}
+			if req.Channel != nil {
+				wifi.Channel = *req.Channel
+			}
+		})
+	}
+
+	wifi := s.status.get().Wifi
+	band := wifi.Band
+	if req.Band != nil {
+		band = *req.Band
+	}
+	switch {
+	case req.Enabled != nil && !wifi.Enabled, req.Band != nil && wifi.Enabled:
+		if err := s.enableWifi(band); err != nil {
+			writeError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+	case req.Band != nil:
+		s.status.updateWifi(func(wifi *wifiStatus) {
+			wifi.Band = band
+		})
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
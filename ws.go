@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+	"webrtc/fmp4"
+	"webrtc/sink"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsMessage is a message of a WebSocket viewer: "start" and "resize" with
+// the viewer size, "touch" like the touch data channel, or "button" with
+// the name of a button.
+type wsMessage struct {
+	Type   string `json:"type"`
+	Button string `json:"button,omitempty"`
+}
+
+// mseInit announces the init segment that follows as a binary message; the
+// viewer creates its SourceBuffer for codec.
+type mseInit struct {
+	Codec  string `json:"codec"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// serveWS is the delivery for viewers without WebRTC. The video comes as
+// fragmented MP4 in binary messages for Media Source Extensions; text
+// messages carry the events of the status data channel and an "init" event
+// before every init segment. The viewer sends its wsMessages back.
+func (s *session) serveWS(conn *websocket.Conn) {
+	defer conn.Close()
+	send := func(ev event) {
+		if data, err := json.Marshal(ev); err == nil {
+			websocket.Message.Send(conn, string(data))
+		}
+	}
+
+	video := s.mseVideo(conn, send)
+	s.addSink(video)
+	defer func() {
+		s.removeSink(video)
+		video.Close()
+	}()
+
+	events := s.events.subscribe()
+	defer s.events.unsubscribe(events)
+	for _, ev := range s.status.statusEvents() {
+		send(ev)
+	}
+	go func() {
+		for ev := range events {
+			if eventMatches(ev, []string{"dongle", "phone", "wifi", "video", "error", "incident"}) {
+				send(ev)
+			}
+		}
+	}()
+
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(conn, &data); err != nil {
+			return
+		}
+		var msg wsMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			continue
+		}
+		switch msg.Type {
+		case "start":
+			s.startCarPlay(data)
+		case "resize":
+			s.resizeCarPlay(data)
+		case "touch":
+			s.sendTouch(data)
+		case "button":
+			if err := s.pressButton(msg.Button); err != nil {
+				send(event{Type: "error", Time: time.Now(), Data: map[string]string{"message": err.Error()}})
+			}
+		}
+	}
+}
+
+// mseVideo muxes the session's video for one viewer, every frame a fragment
+// sent as it comes. A new init segment follows a change of the video format.
+func (s *session) mseVideo(conn *websocket.Conn, send func(event)) *sink.Callback {
+	var buf bytes.Buffer
+	var mux *fmp4.Writer
+	var current *fmp4.VideoConfig
+	restart := func() {
+		mux = fmp4.NewWriter(&buf, nil)
+		mux.Live = true
+		mux.FrameDuration = time.Second / time.Duration(fps)
+	}
+	restart()
+	return sink.NewCallback(func(f sink.Frame) error {
+		err := mux.WriteVideo(f.Time, f.Data, f.Width, f.Height)
+		if err == fmp4.ErrVideoChanged {
+			restart()
+			err = mux.WriteVideo(f.Time, f.Data, f.Width, f.Height)
+		}
+		if err != nil {
+			log.Printf("[mse] %s\n", err)
+			return err
+		}
+		if video := mux.Video(); video != nil && video != current {
+			current = video
+			send(event{Type: "init", Time: f.Time, Data: mseInit{Codec: video.Codec(), Width: video.Width, Height: video.Height}})
+		}
+		if buf.Len() == 0 {
+			return nil
+		}
+		defer buf.Reset()
+		return websocket.Message.Send(conn, buf.Bytes())
+	}, s.requestKeyFrame)
+}